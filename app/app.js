@@ -156,36 +156,222 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+const TUS_VERSION = "1.0.0";
+const TUS_CHUNK_SIZE = 8 * 1024 * 1024;
+const TUS_MAX_RETRIES = 5;
+
 async function uploadVideoFile(videoID) {
   const videoFile = document.getElementById("video-file").files[0];
   if (!videoFile) return;
 
-  const formData = new FormData();
-  formData.append("video", videoFile);
-
   uploadBtnSelector = "upload-video-btn";
   setUploadButtonState(true, uploadBtnSelector);
 
+  const stopProgress = watchProgress(videoID);
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    await tusUpload(videoID, videoFile);
+    console.log("Video uploaded!");
+    await getVideo(videoID);
+    await waitForProcessing(videoID);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  } finally {
+    stopProgress();
+  }
+
+  setUploadButtonState(false, uploadBtnSelector);
+}
+
+const PROGRESS_LABELS = {
+  upload: "Uploading",
+  transcode: "Processing",
+  store: "Saving",
+};
+
+const EVENTS_RETRY_DELAY = 3000;
+
+// watchProgress shows the server-sent progress events for a video until the
+// returned function is called. EventSource can't send the JWT, so every
+// connection uses a one-time ticket instead.
+function watchProgress(videoID) {
+  const container = document.getElementById("video-progress");
+  const bar = document.getElementById("video-progress-bar");
+  const label = document.getElementById("video-progress-label");
+  let source = null;
+  let stopped = false;
+
+  const onProgress = (event) => {
+    const data = JSON.parse(event.data);
+    container.style.display = "block";
+    if (data.percent !== undefined) {
+      bar.value = data.percent;
+      label.textContent = `${PROGRESS_LABELS[data.stage]} ${data.percent.toFixed(0)}%`;
+    } else {
+      bar.removeAttribute("value");
+      label.textContent = PROGRESS_LABELS[data.stage];
+    }
+  };
+
+  const connect = async () => {
+    const res = await fetch(`/api/videos/${videoID}/events/ticket`, {
       method: "POST",
       headers: {
         Authorization: `Bearer ${localStorage.getItem("token")}`,
       },
-      body: formData,
+    });
+    if (!res.ok || stopped) {
+      return;
+    }
+    const { ticket } = await res.json();
+    if (stopped) {
+      return;
+    }
+    source = new EventSource(`/api/videos/${videoID}/events?ticket=${encodeURIComponent(ticket)}`);
+    for (const stage of Object.keys(PROGRESS_LABELS)) {
+      source.addEventListener(stage, onProgress);
+    }
+    source.addEventListener("status", (event) => {
+      const data = JSON.parse(event.data);
+      showVideoStatus(data.status, data.failure_reason);
+    });
+    // The ticket is spent, so reconnect with a new one instead of letting
+    // EventSource retry the same URL.
+    source.onerror = () => {
+      source.close();
+      if (!stopped) {
+        setTimeout(connect, EVENTS_RETRY_DELAY);
+      }
+    };
+  };
+  connect().catch((err) => console.error(err));
+
+  return () => {
+    stopped = true;
+    if (source) {
+      source.close();
+    }
+    container.style.display = "none";
+  };
+}
+
+const STATUS_POLL_INTERVAL = 2000;
+
+// waitForProcessing polls the video status until the upload is either ready
+// or has failed, then refreshes the video.
+async function waitForProcessing(videoID) {
+  for (;;) {
+    const res = await fetch(`/api/videos/${videoID}/status`);
+    if (!res.ok) {
+      throw new Error("Failed to get video status.");
+    }
+    const data = await res.json();
+    showVideoStatus(data.status, data.failure_reason);
+    if (data.status === "ready") {
+      await getVideo(videoID);
+      return;
+    }
+    if (data.status === "failed") {
+      throw new Error(`Processing failed: ${data.failure_reason}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, STATUS_POLL_INTERVAL));
+  }
+}
+
+function showVideoStatus(status, failureReason) {
+  const statusDisplay = document.getElementById("video-status-display");
+  statusDisplay.textContent = failureReason
+    ? `Status: ${status} (${failureReason})`
+    : `Status: ${status}`;
+}
+
+// tusUpload sends the file with the tus resumable upload protocol. The upload
+// URL is remembered per file, so retrying after a failure or a page reload
+// continues from the last byte the server received.
+async function tusUpload(videoID, file) {
+  const storageKey = `tus:${videoID}:${file.name}:${file.size}:${file.lastModified}`;
+  const headers = {
+    Authorization: `Bearer ${localStorage.getItem("token")}`,
+    "Tus-Resumable": TUS_VERSION,
+  };
+
+  let uploadURL = localStorage.getItem(storageKey);
+  let offset = uploadURL ? await tusGetOffset(uploadURL, headers) : null;
+  if (offset === null) {
+    const res = await fetch(`/api/tus/videos/${videoID}`, {
+      method: "POST",
+      headers: {
+        ...headers,
+        "Upload-Length": String(file.size),
+        "Upload-Metadata": `filename ${btoa(unescape(encodeURIComponent(file.name)))},filetype ${btoa(file.type)}`,
+      },
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to start upload. Error: ${data.error}`);
     }
+    uploadURL = res.headers.get("Location");
+    localStorage.setItem(storageKey, uploadURL);
+    offset = 0;
+  }
 
-    console.log("Video uploaded!");
-    await getVideo(videoID);
-  } catch (error) {
-    alert(`Error: ${error.message}`);
+  let retries = 0;
+  while (offset < file.size) {
+    const chunk = file.slice(offset, offset + TUS_CHUNK_SIZE);
+    try {
+      const res = await fetch(uploadURL, {
+        method: "PATCH",
+        headers: {
+          ...headers,
+          "Content-Type": "application/offset+octet-stream",
+          "Upload-Offset": String(offset),
+        },
+        body: chunk,
+      });
+      if (!res.ok) {
+        const data = await res.json().catch(() => ({}));
+        if (res.status < 500 && res.status !== 409) {
+          localStorage.removeItem(storageKey);
+          throw new Error(`Failed to upload video file. Error: ${data.error}`);
+        }
+        throw new TusRetryableError(data.error || res.statusText);
+      }
+      offset = Number(res.headers.get("Upload-Offset"));
+      retries = 0;
+    } catch (error) {
+      if (!(error instanceof TusRetryableError || error instanceof TypeError)) {
+        throw error;
+      }
+      retries++;
+      if (retries > TUS_MAX_RETRIES) {
+        throw new Error(`Upload interrupted, try again to resume. ${error.message}`);
+      }
+      await new Promise((resolve) => setTimeout(resolve, 1000 * 2 ** retries));
+      let current;
+      try {
+        current = await tusGetOffset(uploadURL, headers);
+      } catch {
+        continue;
+      }
+      if (current === null) {
+        localStorage.removeItem(storageKey);
+        throw new Error("Upload expired, please try again.");
+      }
+      offset = current;
+    }
   }
 
-  setUploadButtonState(false, uploadBtnSelector);
+  localStorage.removeItem(storageKey);
+}
+
+class TusRetryableError extends Error {}
+
+// tusGetOffset returns null when the server no longer knows the upload.
+async function tusGetOffset(uploadURL, headers) {
+  const res = await fetch(uploadURL, { method: "HEAD", headers });
+  if (!res.ok) {
+    return null;
+  }
+  return Number(res.headers.get("Upload-Offset"));
 }
 
 const videoStateHandler = createVideoStateHandler();
@@ -260,6 +446,7 @@ function viewVideo(video) {
   document.getElementById("video-title-display").textContent = video.title;
   document.getElementById("video-description-display").textContent =
     video.description;
+  showVideoStatus(video.status, video.failure_reason);
 
   const thumbnailImg = document.getElementById("thumbnail-image");
   if (!video.thumbnail_url) {
@@ -267,6 +454,20 @@ function viewVideo(video) {
   } else {
     thumbnailImg.style.display = "block";
     thumbnailImg.src = video.thumbnail_url;
+    if (video.thumbnail_srcset) {
+      thumbnailImg.srcset = video.thumbnail_srcset;
+    } else {
+      thumbnailImg.removeAttribute("srcset");
+    }
+    const picture = document.getElementById("thumbnail-picture");
+    picture.querySelectorAll("source").forEach((source) => source.remove());
+    for (const source of video.thumbnail_sources || []) {
+      const el = document.createElement("source");
+      el.type = source.type;
+      el.srcset = source.srcset;
+      el.sizes = thumbnailImg.sizes;
+      picture.insertBefore(el, thumbnailImg);
+    }
   }
 
   const videoPlayer = document.getElementById("video-player");
@@ -275,13 +476,33 @@ function viewVideo(video) {
       videoPlayer.style.display = "none";
     } else {
       videoPlayer.style.display = "block";
-
-      videoPlayer.src = video.video_url;
-      videoPlayer.load();
+      playVideo(videoPlayer, video.video_url);
     }
   }
 }
 
+let hlsPlayer = null;
+
+// playVideo loads a video URL into the player. HLS playlists play natively in
+// Safari and through hls.js everywhere else.
+function playVideo(videoPlayer, url) {
+  if (hlsPlayer) {
+    hlsPlayer.destroy();
+    hlsPlayer = null;
+  }
+
+  const isHLS = new URL(url, location.href).pathname.endsWith(".m3u8");
+  if (isHLS && !videoPlayer.canPlayType("application/vnd.apple.mpegurl") && window.Hls?.isSupported()) {
+    hlsPlayer = new Hls();
+    hlsPlayer.loadSource(url);
+    hlsPlayer.attachMedia(videoPlayer);
+    return;
+  }
+
+  videoPlayer.src = url;
+  videoPlayer.load();
+}
+
 async function deleteVideo() {
   if (!currentVideo) {
     alert("No video selected for deletion.");
@@ -298,7 +519,12 @@ async function deleteVideo() {
     if (!res.ok) {
       throw new Error("Failed to delete video.");
     }
-    alert("Video deleted successfully.");
+    if (res.status === 202) {
+      const data = await res.json();
+      alert(data.message);
+    } else {
+      alert("Video deleted successfully.");
+    }
     document.getElementById("video-display").style.display = "none";
     await getVideos();
   } catch (error) {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+const defaultAspectTolerance = 0.02
+
+// aspectCategories are checked in order; each name is also the storage
+// prefix videos of that shape are stored under. Anything else is "other".
+var aspectCategories = []struct {
+	name  string
+	ratio float64
+}{
+	{"landscape", 16.0 / 9.0},
+	{"portrait", 9.0 / 16.0},
+	{"square", 1},
+	{"landscape-4x3", 4.0 / 3.0},
+	{"portrait-3x4", 3.0 / 4.0},
+}
+
+// classifyAspect names the shape of a width x height frame. tolerance is the
+// relative difference still accepted, so 0.02 lets 1920x1088 count as 16:9.
+func classifyAspect(width, height, tolerance float64) string {
+	if width <= 0 || height <= 0 {
+		return "other"
+	}
+	ratio := width / height
+	for _, category := range aspectCategories {
+		if math.Abs(ratio/category.ratio-1) <= tolerance {
+			return category.name
+		}
+	}
+	return "other"
+}
+
+// rotation returns how far players turn the stream, in degrees, from
+// the display matrix side data or the older "rotate" tag.
+func (s StreamInfo) rotation() int {
+	degrees := 0.0
+	for _, side := range s.SideData {
+		if side.Type == "Display Matrix" {
+			degrees = side.Rotation
+		}
+	}
+	if degrees == 0 && s.Tags.Rotate != "" {
+		degrees, _ = strconv.ParseFloat(s.Tags.Rotate, 64)
+	}
+	rotation := int(math.Round(degrees)) % 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return rotation
+}
+
+// orientedSize is the frame size after rotation, which is also what ffmpeg
+// decodes to since it rotates automatically.
+func (s StreamInfo) orientedSize() (int, int) {
+	if rotation := s.rotation(); rotation == 90 || rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// displaySize is the shape the video is shown in: the oriented frame
+// stretched by the sample aspect ratio of anamorphic video.
+func (s StreamInfo) displaySize() (float64, float64) {
+	width, height := s.orientedSize()
+	w, h := float64(width), float64(height)
+
+	sarWidth, sarHeight, ok := parseRatio(s.SampleAspectRatio)
+	if !ok {
+		return w, h
+	}
+	if rotation := s.rotation(); rotation == 90 || rotation == 270 {
+		return w, h * sarWidth / sarHeight
+	}
+	return w * sarWidth / sarHeight, h
+}
+
+// parseRatio reads "num:den". ffprobe reports "0:1" when it doesn't know.
+func parseRatio(value string) (float64, float64, bool) {
+	num, den, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, false
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0, 0, false
+	}
+	return n, d, true
+}
+
+// aspectCategory classifies the first video stream.
+func (info VideoInformation) aspectCategory(tolerance float64) string {
+	stream, ok := info.videoStream()
+	if !ok {
+		return "other"
+	}
+	width, height := stream.displaySize()
+	return classifyAspect(width, height, tolerance)
+}
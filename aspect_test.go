@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestClassifyAspect(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height float64
+		tolerance     float64
+		want          string
+	}{
+		{"1920x1080", 1920, 1080, defaultAspectTolerance, "landscape"},
+		{"1080x1920", 1080, 1920, defaultAspectTolerance, "portrait"},
+		{"square", 1080, 1080, defaultAspectTolerance, "square"},
+		{"4:3", 1024, 768, defaultAspectTolerance, "landscape-4x3"},
+		{"3:4", 768, 1024, defaultAspectTolerance, "portrait-3x4"},
+		{"within tolerance", 1920, 1088, defaultAspectTolerance, "landscape"},
+		{"outside tolerance", 1920, 1088, 0, "other"},
+		{"ultrawide", 2560, 1080, defaultAspectTolerance, "other"},
+		{"no height", 1920, 0, defaultAspectTolerance, "other"},
+		{"negative width", -1920, 1080, defaultAspectTolerance, "other"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyAspect(tc.width, tc.height, tc.tolerance); got != tc.want {
+				t.Errorf("classifyAspect(%v, %v, %v) = %q, want %q", tc.width, tc.height, tc.tolerance, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStreamDisplaySize(t *testing.T) {
+	// Streams as ffprobe prints them with -show_streams.
+	tests := []struct {
+		name          string
+		stream        string
+		width, height float64
+		category      string
+	}{
+		{
+			name:     "1920x1080",
+			stream:   `{"width": 1920, "height": 1080, "sample_aspect_ratio": "1:1"}`,
+			width:    1920,
+			height:   1080,
+			category: "landscape",
+		},
+		{
+			name:     "1080x1920",
+			stream:   `{"width": 1080, "height": 1920}`,
+			width:    1080,
+			height:   1920,
+			category: "portrait",
+		},
+		{
+			name:     "phone video rotated 90 degrees",
+			stream:   `{"width": 1920, "height": 1080, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}`,
+			width:    1080,
+			height:   1920,
+			category: "portrait",
+		},
+		{
+			name:     "older rotate tag",
+			stream:   `{"width": 1920, "height": 1080, "tags": {"rotate": "90"}}`,
+			width:    1080,
+			height:   1920,
+			category: "portrait",
+		},
+		{
+			name:     "upside down",
+			stream:   `{"width": 1920, "height": 1080, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": 180}]}`,
+			width:    1920,
+			height:   1080,
+			category: "landscape",
+		},
+		{
+			name:     "4:3",
+			stream:   `{"width": 640, "height": 480, "sample_aspect_ratio": "1:1"}`,
+			width:    640,
+			height:   480,
+			category: "landscape-4x3",
+		},
+		{
+			name:     "square",
+			stream:   `{"width": 720, "height": 720}`,
+			width:    720,
+			height:   720,
+			category: "square",
+		},
+		{
+			name:     "anamorphic PAL widescreen",
+			stream:   `{"width": 720, "height": 576, "sample_aspect_ratio": "64:45"}`,
+			width:    1024,
+			height:   576,
+			category: "landscape",
+		},
+		{
+			name:     "anamorphic rotated 90 degrees",
+			stream:   `{"width": 720, "height": 576, "sample_aspect_ratio": "64:45", "tags": {"rotate": "90"}}`,
+			width:    576,
+			height:   1024,
+			category: "portrait",
+		},
+		{
+			name:     "unknown sample aspect ratio",
+			stream:   `{"width": 720, "height": 576, "sample_aspect_ratio": "0:1"}`,
+			width:    720,
+			height:   576,
+			category: "other",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var stream StreamInfo
+			if err := json.Unmarshal([]byte(tc.stream), &stream); err != nil {
+				t.Fatal(err)
+			}
+			stream.CodecType = "video"
+
+			width, height := stream.displaySize()
+			if width != tc.width || height != tc.height {
+				t.Errorf("displaySize() = %vx%v, want %vx%v", width, height, tc.width, tc.height)
+			}
+			info := VideoInformation{Data: []StreamInfo{{CodecType: "audio"}, stream}}
+			if got := info.aspectCategory(defaultAspectTolerance); got != tc.category {
+				t.Errorf("aspectCategory() = %q, want %q", got, tc.category)
+			}
+		})
+	}
+}
+
+func TestParseRatio(t *testing.T) {
+	tests := []struct {
+		value    string
+		num, den float64
+		ok       bool
+	}{
+		{"16:9", 16, 9, true},
+		{"64:45", 64, 45, true},
+		{"1:1", 1, 1, true},
+		{"0:1", 0, 0, false},
+		{"1:0", 0, 0, false},
+		{"-4:3", 0, 0, false},
+		{"16/9", 0, 0, false},
+		{"a:b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, tc := range tests {
+		num, den, ok := parseRatio(tc.value)
+		if num != tc.num || den != tc.den || ok != tc.ok {
+			t.Errorf("parseRatio(%q) = %v, %v, %v, want %v, %v, %v", tc.value, num, den, ok, tc.num, tc.den, tc.ok)
+		}
+	}
+}
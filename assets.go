@@ -1,7 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Kinds of objects tracked in video_assets.
+const (
+	assetKindVideo     = "video"
+	assetKindThumbnail = "thumbnail"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +24,116 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// newAssetKey returns a random storage key below prefix with the given
+// file extension, e.g. "landscape/<random>.mp4".
+func newAssetKey(prefix, ext string) string {
+	name := fmt.Sprintf("%s.%s", randomAssetName(), ext)
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// newAssetPrefix returns a random directory-like prefix below prefix for
+// assets made of many objects, e.g. "hls/<video id>/<random>/".
+func newAssetPrefix(prefix string) string {
+	return prefix + "/" + randomAssetName() + "/"
+}
+
+func randomAssetName() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// recordVideoAsset tracks a newly stored object as the current asset of its
+// kind. If the video still points at an untracked object from before assets
+// were recorded, that object is adopted first so retention can clean it up.
+func (cfg *apiConfig) recordVideoAsset(video database.Video, kind, key string, isPrefix bool, previousURL *string) error {
+	if previousKey, ok := cfg.storageKeyFromURL(previousURL); ok {
+		assets, err := cfg.db.GetVideoAssets(video.ID)
+		if err != nil {
+			return err
+		}
+		tracked := false
+		for _, asset := range assets {
+			if asset.Kind == kind {
+				tracked = true
+				break
+			}
+		}
+		if !tracked {
+			_, err := cfg.db.CreateVideoAsset(database.CreateVideoAssetParams{
+				VideoID: video.ID,
+				Kind:    kind,
+				Key:     previousKey,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := cfg.db.CreateVideoAsset(database.CreateVideoAssetParams{
+		VideoID:  video.ID,
+		Kind:     kind,
+		Key:      key,
+		IsPrefix: isPrefix,
+	})
+	if errors.Is(err, database.ErrVideoDeleted) {
+		// Nothing will ever reference the object, so don't wait for gc.
+		if deleteErr := cfg.deleteStoredObject(context.Background(), key, isPrefix); deleteErr != nil {
+			log.Printf("Couldn't remove %s of deleted video %s: %v", key, video.ID, deleteErr)
+		}
+	}
+	return err
+}
+
+// retireVideoAssets applies the video's keep_versions policy to assets of
+// kind once the video row points at the newest one. Objects that can't be
+// removed right away stay in the deletion outbox.
+func (cfg *apiConfig) retireVideoAssets(ctx context.Context, video database.Video, kind string) {
+	pending, err := cfg.db.RetireVideoAssets(video.ID, kind, video.KeepVersions)
+	if err != nil {
+		log.Printf("Couldn't retire old %s assets for video %s: %v", kind, video.ID, err)
+		return
+	}
+	if failed := cfg.purgePendingDeletions(ctx, pending); len(failed) > 0 {
+		log.Printf("Queued %d old %s object(s) of video %s for retry", len(failed), kind, video.ID)
+	}
+}
+
+// retireOutputAssets retires optional outputs of kind after processing.
+// When this run produced one, older versions follow keep_versions; when it
+// didn't, the video no longer points at any of them and all are retired.
+func (cfg *apiConfig) retireOutputAssets(ctx context.Context, video database.Video, kind string, produced bool) {
+	if produced {
+		cfg.retireVideoAssets(ctx, video, kind)
+		return
+	}
+	pending, err := cfg.db.RetireVideoAssets(video.ID, kind, -1)
+	if err != nil {
+		log.Printf("Couldn't retire %s assets for video %s: %v", kind, video.ID, err)
+		return
+	}
+	if failed := cfg.purgePendingDeletions(ctx, pending); len(failed) > 0 {
+		log.Printf("Queued %d %s object(s) of video %s for retry", len(failed), kind, video.ID)
+	}
+}
+
+// currentAssetKey returns the key of the newest asset of kind, falling back
+// to legacyURL for videos stored before assets were tracked.
+func (cfg *apiConfig) currentAssetKey(video database.Video, kind string, legacyURL *string) (string, bool, error) {
+	assets, err := cfg.db.GetVideoAssets(video.ID)
+	if err != nil {
+		return "", false, err
+	}
+	for _, asset := range assets {
+		if asset.Kind == kind {
+			return asset.Key, true, nil
+		}
+	}
+	key, ok := cfg.storageKeyFromURL(legacyURL)
+	return key, ok, nil
+}
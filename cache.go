@@ -1,10 +1,326 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
 
-func noCacheMiddleware(next http.Handler) http.Handler {
+// Named cache policies for CACHE_RULES.
+const (
+	cachePolicyImmutable  = "immutable"
+	cachePolicyShort      = "short"
+	cachePolicyRevalidate = "revalidate"
+	cachePolicyNoStore    = "no-store"
+)
+
+// defaultCacheRules: asset keys are random or content-addressed, so stored
+// objects never change, except that HLS and DASH manifests are kept short in
+// case players or CDNs need to pick up a re-packaged stream. The web app is
+// revalidated on every load, and API responses are never stored unless a
+// handler says otherwise.
+const defaultCacheRules = "/assets/*.m3u8=short,/assets/*.mpd=short,/assets/=immutable,/app/=revalidate,/api/=no-store"
+
+const (
+	defaultCacheShortMaxAge = time.Minute
+	defaultCacheLRUMB       = 64
+
+	// cacheLRUMaxObjectSize keeps the in-process cache for small, hot
+	// assets such as thumbnails; anything larger is always read through.
+	cacheLRUMaxObjectSize = 1 << 20
+	// cacheLRUMaxAge bounds how long a deleted asset can still be served
+	// from memory.
+	cacheLRUMaxAge = 5 * time.Minute
+)
+
+// cacheRule applies a Cache-Control value to request paths starting with
+// prefix and, if set, ending with suffix.
+type cacheRule struct {
+	prefix  string
+	suffix  string
+	control string
+}
+
+// parseCacheRules reads CACHE_RULES, a comma separated list of
+// "<path prefix>[*<suffix>]=<policy>" entries. The first matching rule wins.
+func parseCacheRules(value string, shortMaxAge time.Duration) ([]cacheRule, error) {
+	controls := map[string]string{
+		cachePolicyImmutable:  "public, max-age=31536000, immutable",
+		cachePolicyShort:      fmt.Sprintf("public, max-age=%d", int(shortMaxAge.Seconds())),
+		cachePolicyRevalidate: "public, no-cache",
+		cachePolicyNoStore:    "no-store",
+	}
+
+	rules := []cacheRule{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		pattern, policy, ok := strings.Cut(field, "=")
+		if !ok || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("invalid rule %q, use <path prefix>=<policy>", field)
+		}
+		control, ok := controls[strings.TrimSpace(policy)]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q, use immutable, short, revalidate or no-store", policy)
+		}
+		prefix, suffix, _ := strings.Cut(strings.TrimSpace(pattern), "*")
+		rules = append(rules, cacheRule{prefix: prefix, suffix: suffix, control: control})
+	}
+	return rules, nil
+}
+
+// cachePolicy sets Cache-Control by CACHE_RULES and, when lru is set, keeps
+// small immutable responses in memory.
+type cachePolicy struct {
+	rules []cacheRule
+	lru   *responseCache
+}
+
+func (p *cachePolicy) match(path string) (cacheRule, bool) {
+	for _, rule := range p.rules {
+		if strings.HasPrefix(path, rule.prefix) && strings.HasSuffix(path, rule.suffix) {
+			return rule, true
+		}
+	}
+	return cacheRule{}, false
+}
+
+// middleware applies the matching rule's Cache-Control to responses whose
+// handler didn't set one itself, like the thumbnail endpoint does. Errors
+// are never stored, so a missing object can't stick in a cache for a year.
+func (p *cachePolicy) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
-		next.ServeHTTP(w, r)
+		writer := &cacheWriter{ResponseWriter: w, status: http.StatusOK}
+		if rule, ok := p.match(r.URL.Path); ok {
+			writer.control = rule.control
+		}
+		if p.lru == nil || r.Method != http.MethodGet || r.Header.Get("Range") != "" || hasCredentials(r) {
+			next.ServeHTTP(writer, r)
+			return
+		}
+
+		if entry, ok := p.lru.get(r); ok {
+			entry.serve(w, r)
+			return
+		}
+		writer.record = true
+		next.ServeHTTP(writer, r)
+		if writer.cacheable() {
+			p.lru.add(r, writer.entry(r.URL.Path))
+		}
 	})
 }
+
+// hasCredentials reports whether r may get a response meant only for its
+// sender. The in-process cache isn't keyed by user, so such requests bypass
+// it.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// cacheWriter sets Cache-Control once the response status is known and,
+// with record set, keeps a copy of small bodies for the in-process cache.
+type cacheWriter struct {
+	http.ResponseWriter
+	control     string
+	record      bool
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	tooLarge    bool
+	streamed    bool
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+		if cw.control != "" && cw.Header().Get("Cache-Control") == "" {
+			if status >= http.StatusBadRequest {
+				cw.Header().Set("Cache-Control", "no-store")
+			} else {
+				cw.Header().Set("Cache-Control", cw.control)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.record && !cw.tooLarge {
+		if cw.body.Len()+len(p) > cacheLRUMaxObjectSize {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses such as server-sent events working. They
+// are never cached.
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.streamed = true
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheable reports whether the response may be served from memory: a
+// complete 200 that its Cache-Control marks as never changing and shared,
+// and that doesn't vary on everything.
+func (cw *cacheWriter) cacheable() bool {
+	header := cw.Header()
+	control := header.Get("Cache-Control")
+	return cw.status == http.StatusOK &&
+		!cw.tooLarge &&
+		!cw.streamed &&
+		strings.Contains(control, "immutable") &&
+		!strings.Contains(control, "private") &&
+		header.Get("Vary") != "*"
+}
+
+func (cw *cacheWriter) entry(path string) *cachedResponse {
+	header := cw.Header().Clone()
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	return &cachedResponse{
+		path:     path,
+		header:   header,
+		body:     bytes.Clone(cw.body.Bytes()),
+		modTime:  modTime,
+		storedAt: time.Now(),
+	}
+}
+
+type cachedResponse struct {
+	path     string
+	key      string
+	header   http.Header
+	body     []byte
+	modTime  time.Time
+	storedAt time.Time
+}
+
+// serve answers from memory. http.ServeContent takes care of conditional
+// and range requests against the stored ETag and Last-Modified.
+func (c *cachedResponse) serve(w http.ResponseWriter, r *http.Request) {
+	for name, values := range c.header {
+		if name == "Content-Length" || name == "Date" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	http.ServeContent(w, r, "", c.modTime, bytes.NewReader(c.body))
+}
+
+// responseCache is a least recently used cache of responses, bounded by
+// entry count and total body size.
+type responseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	order      *list.List
+	entries    map[string]*list.Element
+	// vary remembers the Vary header names of each cached path, so the key
+	// of a request can be built before its response is known.
+	vary map[string][]string
+}
+
+func newResponseCache(maxEntries, maxBytes int) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+		vary:       map[string][]string{},
+	}
+}
+
+// cacheKey identifies a response by its URL and the request headers the
+// response varies on.
+func cacheKey(r *http.Request, varyNames []string) string {
+	var key strings.Builder
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range varyNames {
+		key.WriteString("\x00")
+		key.WriteString(r.Header.Get(name))
+	}
+	return key.String()
+}
+
+func varyNames(header http.Header) []string {
+	names := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func (c *responseCache) get(r *http.Request) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[cacheKey(r, c.vary[r.URL.Path])]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedResponse)
+	if time.Since(entry.storedAt) > cacheLRUMaxAge {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+func (c *responseCache) add(r *http.Request, entry *cachedResponse) {
+	if len(entry.body) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := varyNames(entry.header)
+	c.vary[r.URL.Path] = names
+	entry.key = cacheKey(r, names)
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.bytes += len(entry.body)
+
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cachedResponse)
+	delete(c.entries, entry.key)
+	// Other variants of the path become unreachable until they are stored
+	// again, which only costs a miss.
+	delete(c.vary, entry.path)
+	c.bytes -= len(entry.body)
+}
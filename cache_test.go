@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCacheRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []cacheRule
+		wantErr bool
+	}{
+		{
+			name:  "prefix and suffix",
+			value: " /assets/*.m3u8 = short , /app/=revalidate,",
+			want: []cacheRule{
+				{prefix: "/assets/", suffix: ".m3u8", control: "public, max-age=30"},
+				{prefix: "/app/", control: "public, no-cache"},
+			},
+		},
+		{
+			name:  "all policies",
+			value: "/a/=immutable,/b/=short,/c/=revalidate,/d/=no-store",
+			want: []cacheRule{
+				{prefix: "/a/", control: "public, max-age=31536000, immutable"},
+				{prefix: "/b/", control: "public, max-age=30"},
+				{prefix: "/c/", control: "public, no-cache"},
+				{prefix: "/d/", control: "no-store"},
+			},
+		},
+		{name: "empty", value: "", want: []cacheRule{}},
+		{name: "missing policy", value: "/assets/", wantErr: true},
+		{name: "relative path", value: "assets/=immutable", wantErr: true},
+		{name: "unknown policy", value: "/assets/=forever", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCacheRules(tc.value, 30*time.Second)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseCacheRules() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCacheRules() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("parseCacheRules() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCachePolicyMatch(t *testing.T) {
+	defaults, err := parseCacheRules(defaultCacheRules, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same rules in the opposite order: the first match wins, so the
+	// manifests are no longer picked out.
+	reversed, err := parseCacheRules("/assets/=immutable,/assets/*.m3u8=short", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rules []cacheRule
+		path  string
+		want  string
+	}{
+		{"hls manifest", defaults, "/assets/hls/v/abc/master.m3u8", "public, max-age=60"},
+		{"dash manifest", defaults, "/assets/dash/v/abc/manifest.mpd", "public, max-age=60"},
+		{"segment", defaults, "/assets/hls/v/abc/720p/seg_000.ts", "public, max-age=31536000, immutable"},
+		{"web app", defaults, "/app/index.html", "public, no-cache"},
+		{"api", defaults, "/api/videos", "no-store"},
+		{"no match", defaults, "/admin/reset", ""},
+		{"suffix must be at the end", defaults, "/assets/a.m3u8.bak", "public, max-age=31536000, immutable"},
+		{"first match wins", reversed, "/assets/hls/master.m3u8", "public, max-age=31536000, immutable"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := cachePolicy{rules: tc.rules}
+			rule, _ := policy.match(tc.path)
+			if rule.control != tc.want {
+				t.Errorf("match(%q) = %q, want %q", tc.path, rule.control, tc.want)
+			}
+		})
+	}
+}
+
+// countingHandler answers with a body that names the request's Accept
+// header and counts how often it ran.
+type countingHandler struct {
+	calls   int
+	status  int
+	control string
+	vary    string
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+	if h.control != "" {
+		w.Header().Set("Cache-Control", h.control)
+	}
+	if h.vary != "" {
+		w.Header().Set("Vary", h.vary)
+	}
+	if h.status != 0 {
+		w.WriteHeader(h.status)
+	}
+	fmt.Fprintf(w, "body for %q", r.Header.Get("Accept"))
+}
+
+func newTestCachePolicy(t *testing.T) *cachePolicy {
+	t.Helper()
+	rules, err := parseCacheRules(defaultCacheRules, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cachePolicy{rules: rules, lru: newResponseCache(10, 1<<20)}
+}
+
+func serveCached(handler http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	t.Run("immutable responses are served from memory", func(t *testing.T) {
+		next := &countingHandler{}
+		handler := newTestCachePolicy(t).middleware(next)
+
+		first := serveCached(handler, "/assets/a.jpg", nil)
+		second := serveCached(handler, "/assets/a.jpg", nil)
+		if next.calls != 1 {
+			t.Errorf("handler ran %d times, want 1", next.calls)
+		}
+		if second.Body.String() != first.Body.String() {
+			t.Errorf("cached body = %q, want %q", second.Body.String(), first.Body.String())
+		}
+		if got := second.Header().Get("Cache-Control"); got != "public, max-age=31536000, immutable" {
+			t.Errorf("cached Cache-Control = %q", got)
+		}
+	})
+
+	t.Run("handler Cache-Control wins", func(t *testing.T) {
+		next := &countingHandler{control: "public, max-age=5"}
+		handler := newTestCachePolicy(t).middleware(next)
+
+		w := serveCached(handler, "/assets/a.jpg", nil)
+		serveCached(handler, "/assets/a.jpg", nil)
+		if got := w.Header().Get("Cache-Control"); got != "public, max-age=5" {
+			t.Errorf("Cache-Control = %q, want the handler's", got)
+		}
+		if next.calls != 2 {
+			t.Errorf("handler ran %d times, want 2 for a response that isn't immutable", next.calls)
+		}
+	})
+
+	t.Run("errors are never stored", func(t *testing.T) {
+		next := &countingHandler{status: http.StatusNotFound}
+		policy := newTestCachePolicy(t)
+		handler := policy.middleware(next)
+
+		w := serveCached(handler, "/assets/missing.jpg", nil)
+		serveCached(handler, "/assets/missing.jpg", nil)
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", got)
+		}
+		if next.calls != 2 {
+			t.Errorf("handler ran %d times, want 2", next.calls)
+		}
+		if n := policy.lru.order.Len(); n != 0 {
+			t.Errorf("cache holds %d entries, want 0", n)
+		}
+	})
+
+	t.Run("entries are kept per Vary value", func(t *testing.T) {
+		next := &countingHandler{vary: "Accept"}
+		handler := newTestCachePolicy(t).middleware(next)
+
+		for _, accept := range []string{"image/avif", "image/webp", "image/avif", "image/webp"} {
+			w := serveCached(handler, "/assets/a.jpg", http.Header{"Accept": {accept}})
+			if want := fmt.Sprintf("body for %q", accept); w.Body.String() != want {
+				t.Errorf("Accept %s: body = %q, want %q", accept, w.Body.String(), want)
+			}
+		}
+		if next.calls != 2 {
+			t.Errorf("handler ran %d times, want 2", next.calls)
+		}
+	})
+
+	t.Run("requests with credentials bypass the cache", func(t *testing.T) {
+		next := &countingHandler{}
+		policy := newTestCachePolicy(t)
+		handler := policy.middleware(next)
+
+		for _, header := range []http.Header{
+			{"Authorization": {"Bearer a"}},
+			{"Authorization": {"Bearer b"}},
+			{"Cookie": {"session=a"}},
+		} {
+			serveCached(handler, "/assets/a.jpg", header)
+		}
+		if next.calls != 3 {
+			t.Errorf("handler ran %d times, want 3", next.calls)
+		}
+		if n := policy.lru.order.Len(); n != 0 {
+			t.Errorf("cache holds %d entries, want 0", n)
+		}
+	})
+
+	t.Run("private responses aren't stored", func(t *testing.T) {
+		next := &countingHandler{control: "private, max-age=31536000, immutable"}
+		handler := newTestCachePolicy(t).middleware(next)
+
+		serveCached(handler, "/assets/a.jpg", nil)
+		serveCached(handler, "/assets/a.jpg", nil)
+		if next.calls != 2 {
+			t.Errorf("handler ran %d times, want 2", next.calls)
+		}
+	})
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	request := func(path string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, path, nil)
+	}
+	entry := func(path string, size int) *cachedResponse {
+		return &cachedResponse{path: path, header: http.Header{}, body: make([]byte, size), storedAt: time.Now()}
+	}
+
+	t.Run("by entries, least recently used first", func(t *testing.T) {
+		cache := newResponseCache(2, 1<<20)
+		cache.add(request("/a"), entry("/a", 1))
+		cache.add(request("/b"), entry("/b", 1))
+		cache.get(request("/a"))
+		cache.add(request("/c"), entry("/c", 1))
+
+		for path, want := range map[string]bool{"/a": true, "/b": false, "/c": true} {
+			if _, ok := cache.get(request(path)); ok != want {
+				t.Errorf("get(%s) cached = %v, want %v", path, ok, want)
+			}
+		}
+	})
+
+	t.Run("by bytes", func(t *testing.T) {
+		cache := newResponseCache(10, 10)
+		cache.add(request("/a"), entry("/a", 6))
+		cache.add(request("/b"), entry("/b", 6))
+		cache.add(request("/big"), entry("/big", 11))
+
+		for path, want := range map[string]bool{"/a": false, "/b": true, "/big": false} {
+			if _, ok := cache.get(request(path)); ok != want {
+				t.Errorf("get(%s) cached = %v, want %v", path, ok, want)
+			}
+		}
+		if cache.bytes != 6 {
+			t.Errorf("cache holds %d bytes, want 6", cache.bytes)
+		}
+	})
+
+	t.Run("by age", func(t *testing.T) {
+		cache := newResponseCache(10, 1<<20)
+		stale := entry("/a", 1)
+		cache.add(request("/a"), stale)
+		stale.storedAt = time.Now().Add(-cacheLRUMaxAge - time.Second)
+
+		if _, ok := cache.get(request("/a")); ok {
+			t.Error("get(/a) served an entry older than cacheLRUMaxAge")
+		}
+		if cache.bytes != 0 {
+			t.Errorf("cache holds %d bytes, want 0", cache.bytes)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	assetKindDASH = "dash"
+	dashManifest  = "manifest.mpd"
+)
+
+// packageDASH writes an MPD with fragmented MP4 segments for the encoded
+// renditions to outDir without re-encoding. All renditions share one video
+// adaptation set; audio is taken from the first rendition only since every
+// rendition carries the same track.
+func packageDASH(ctx context.Context, files []string, hasAudio bool, outDir string, segmentTime time.Duration) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	args := []string{"-v", "error", "-y"}
+	for _, file := range files {
+		args = append(args, "-i", file)
+	}
+	for i := range files {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", formatSeconds(segmentTime),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outDir, dashManifest),
+	)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
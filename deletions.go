@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	deletionOutboxInterval = time.Minute
+	deletionOutboxBatch    = 100
+	deletionMaxBackoff     = 6 * time.Hour
+)
+
+// keyLocks serializes work on the same storage key, so a queued deletion
+// can't remove an object while it is being stored again.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	holders int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*keyLock{}}
+}
+
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	m, ok := l.locks[key]
+	if !ok {
+		m = &keyLock{}
+		l.locks[key] = m
+	}
+	m.holders++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		m.holders--
+		if m.holders == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// storageKeyFromURL maps a URL handed out by the store back to its key.
+// It is used for videos stored before assets were tracked in video_assets.
+func (cfg *apiConfig) storageKeyFromURL(url *string) (string, bool) {
+	return keyFromStoreURL(cfg.store, url)
+}
+
+func keyFromStoreURL(store storage.BlobStore, url *string) (string, bool) {
+	if url == nil {
+		return "", false
+	}
+	base := store.URL("")
+	if !strings.HasPrefix(*url, base) || len(*url) == len(base) {
+		return "", false
+	}
+	return strings.TrimPrefix(*url, base), true
+}
+
+// deleteStoredObject removes a single object, or every object below the key
+// when isPrefix is set.
+func (cfg *apiConfig) deleteStoredObject(ctx context.Context, key string, isPrefix bool) error {
+	if !isPrefix {
+		return cfg.store.Delete(ctx, key)
+	}
+
+	objects, err := cfg.store.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgePendingDeletions tries to remove each queued object now. Entries that
+// fail stay in the outbox for runDeletionOutbox to retry, and their keys are
+// returned.
+func (cfg *apiConfig) purgePendingDeletions(ctx context.Context, pending []database.PendingDeletion) []string {
+	failed := []string{}
+	for _, entry := range pending {
+		err := cfg.purgePendingDeletion(ctx, entry)
+		if err != nil {
+			log.Printf("Couldn't delete stored object %s (attempt %d): %v", entry.Key, entry.Attempts+1, err)
+			next := time.Now().Add(deletionBackoff(entry.Attempts + 1))
+			if markErr := cfg.db.MarkPendingDeletionFailed(entry.ID, err.Error(), next); markErr != nil {
+				log.Printf("Couldn't record failed deletion of %s: %v", entry.Key, markErr)
+			}
+			failed = append(failed, entry.Key)
+			continue
+		}
+
+		if err := cfg.db.DeletePendingDeletion(entry.ID); err != nil {
+			log.Printf("Couldn't clear pending deletion of %s: %v", entry.Key, err)
+		}
+	}
+	return failed
+}
+
+// purgePendingDeletion removes a queued object unless its key was stored
+// again since: the key is locked against uploads and checked against
+// video_assets before anything is deleted.
+func (cfg *apiConfig) purgePendingDeletion(ctx context.Context, entry database.PendingDeletion) error {
+	unlock := cfg.keyLocks.lock(entry.Key)
+	defer unlock()
+
+	due, err := cfg.db.PendingDeletionIsDue(entry.ID, entry.Key)
+	if err != nil || !due {
+		return err
+	}
+	return cfg.deleteStoredObject(ctx, entry.Key, entry.IsPrefix)
+}
+
+// runDeletionOutbox periodically retries deletions that previously failed.
+func (cfg *apiConfig) runDeletionOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pending, err := cfg.db.GetDuePendingDeletions(time.Now(), deletionOutboxBatch)
+		if err != nil {
+			log.Printf("Couldn't load pending deletions: %v", err)
+		} else if len(pending) > 0 {
+			failed := cfg.purgePendingDeletions(ctx, pending)
+			log.Printf("Deletion outbox: removed %d of %d objects", len(pending)-len(failed), len(pending))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deletionBackoff doubles the wait after every failed attempt, starting at
+// one minute and capped at deletionMaxBackoff.
+func deletionBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < deletionMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, deletionMaxBackoff)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// exifOrientationTag is the TIFF tag holding how the camera was held. Values
+// 1 to 8 describe which of the image's corners is its top-left one.
+const exifOrientationTag = 0x0112
+
+// exifHeadLimit bounds how much of an image is searched for EXIF data. It
+// always sits near the start of JPEG, PNG and WebP files.
+const exifHeadLimit = 1 << 20
+
+// readExifOrientation returns the EXIF orientation of the image at path, or
+// 1 (upright) when it has none.
+func readExifOrientation(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer file.Close()
+
+	head, err := io.ReadAll(io.LimitReader(file, exifHeadLimit))
+	if err != nil {
+		return 1
+	}
+	tiff := findExif(head)
+	if tiff == nil {
+		return 1
+	}
+	orientation := parseExifOrientation(tiff)
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// findExif returns the TIFF structure holding the EXIF data of a JPEG (APP1
+// segment), PNG (eXIf chunk) or WebP (EXIF chunk) image.
+func findExif(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		pos := 2
+		for pos+4 <= len(data) && data[pos] == 0xFF {
+			marker := data[pos+1]
+			if marker == 0xDA || marker == 0xD9 {
+				break
+			}
+			size := int(binary.BigEndian.Uint16(data[pos+2:]))
+			if size < 2 || pos+2+size > len(data) {
+				break
+			}
+			segment := data[pos+4 : pos+2+size]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:]
+			}
+			pos += 2 + size
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		pos := 8
+		for pos+12 <= len(data) {
+			size := int(binary.BigEndian.Uint32(data[pos:]))
+			kind := string(data[pos+4 : pos+8])
+			if size < 0 || pos+12+size > len(data) || kind == "IDAT" {
+				break
+			}
+			if kind == "eXIf" {
+				return data[pos+8 : pos+8+size]
+			}
+			pos += 12 + size
+		}
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		pos := 12
+		for pos+8 <= len(data) {
+			size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+			if size < 0 || pos+8+size > len(data) {
+				break
+			}
+			if string(data[pos:pos+4]) == "EXIF" {
+				return bytes.TrimPrefix(data[pos+8:pos+8+size], []byte("Exif\x00\x00"))
+			}
+			pos += 8 + size + size%2
+		}
+	}
+	return nil
+}
+
+// parseExifOrientation reads the orientation tag from the first IFD of a
+// TIFF structure, or returns 0 when it isn't there.
+func parseExifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientationFilter returns the ffmpeg filter that turns an image stored
+// with the given EXIF orientation upright, or "" if it already is.
+func orientationFilter(orientation int) string {
+	switch orientation {
+	case 2:
+		return "hflip"
+	case 3:
+		return "hflip,vflip"
+	case 4:
+		return "vflip"
+	case 5:
+		return "transpose=cclock_flip"
+	case 6:
+		return "transpose=clock"
+	case 7:
+		return "transpose=clock_flip"
+	case 8:
+		return "transpose=cclock"
+	}
+	return ""
+}
+
+// orientationSwapsSides reports whether turning the image upright swaps its
+// width and height.
+func orientationSwapsSides(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
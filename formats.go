@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const assetKindSource = "source"
+
+// allowedInputFormats are the ffprobe format names of containers accepted as
+// uploads. ffprobe reports families, e.g. "mov,mp4,m4a,3gp,3g2,mj2" for
+// QuickTime and MP4 or "matroska,webm" for MKV and WebM.
+var allowedInputFormats = map[string]bool{
+	"mov":      true,
+	"mp4":      true,
+	"matroska": true,
+	"webm":     true,
+}
+
+// webmCodecs are the only codecs a WebM file may contain; a Matroska file
+// with anything else is an MKV.
+var webmCodecs = map[string]bool{
+	"vp8":    true,
+	"vp9":    true,
+	"av1":    true,
+	"opus":   true,
+	"vorbis": true,
+}
+
+// unsupportedVideoError is returned by probeUpload for files that aren't a
+// video Tubely accepts. Its message is meant for the uploader.
+type unsupportedVideoError struct {
+	reason string
+}
+
+func (e unsupportedVideoError) Error() string {
+	return e.reason
+}
+
+// probeUpload identifies an uploaded file by its contents with ffprobe and
+// checks that it is a video in one of the allowed containers.
+func probeUpload(ctx context.Context, path string) (VideoInformation, error) {
+	info, err := probeVideo(ctx, path)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return info, unsupportedVideoError{"couldn't read the uploaded file as a video"}
+		}
+		return info, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	if !info.isAllowedContainer() {
+		return info, unsupportedVideoError{fmt.Sprintf("unsupported container %q, upload MP4, MOV, MKV or WebM", info.Format.FormatName)}
+	}
+	if _, ok := info.videoStream(); !ok {
+		return info, unsupportedVideoError{"the uploaded file has no video stream"}
+	}
+	return info, nil
+}
+
+func (info VideoInformation) formatNames() []string {
+	return strings.Split(info.Format.FormatName, ",")
+}
+
+func (info VideoInformation) hasFormat(name string) bool {
+	for _, format := range info.formatNames() {
+		if format == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (info VideoInformation) isAllowedContainer() bool {
+	for _, format := range info.formatNames() {
+		if allowedInputFormats[format] {
+			return true
+		}
+	}
+	return false
+}
+
+// containerType returns the file extension and media type matching the
+// uploaded container.
+func (info VideoInformation) containerType() (string, string) {
+	switch {
+	case info.hasFormat("mov") && strings.TrimSpace(info.Format.Tags.MajorBrand) == "qt":
+		return "mov", "video/quicktime"
+	case info.hasFormat("mp4"):
+		return "mp4", "video/mp4"
+	case info.hasFormat("matroska"):
+		for _, stream := range info.Data {
+			if (stream.CodecType == "video" || stream.CodecType == "audio") && !webmCodecs[stream.CodecName] {
+				return "mkv", "video/x-matroska"
+			}
+		}
+		return "webm", "video/webm"
+	}
+	return "bin", "application/octet-stream"
+}
+
+// needsTranscode reports which streams aren't already H.264 video or AAC
+// audio and have to be re-encoded for the MP4 output.
+func (info VideoInformation) needsTranscode() (video bool, audio bool) {
+	if stream, ok := info.videoStream(); ok {
+		video = stream.CodecName != "h264"
+	}
+	if stream, ok := info.audioStream(); ok {
+		audio = stream.CodecName != "aac"
+	}
+	return video, audio
+}
+
+// keepSourceFile stores the upload as it was received when KEEP_SOURCE is
+// set, so owners can download their original file.
+func (cfg *apiConfig) keepSourceFile(ctx context.Context, video database.Video, sourcePath string, info VideoInformation) (database.Video, bool, error) {
+	video.SourceURL = nil
+	if !cfg.keepSource {
+		return video, false, nil
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return video, false, fmt.Errorf("couldn't open source file: %w", err)
+	}
+	defer source.Close()
+
+	ext, contentType := info.containerType()
+	sourceKey := newAssetKey("sources", ext)
+	if err := cfg.store.Put(ctx, sourceKey, source, contentType); err != nil {
+		return video, false, fmt.Errorf("couldn't store source file: %w", err)
+	}
+	if err := cfg.recordVideoAsset(video, assetKindSource, sourceKey, false, nil); err != nil {
+		return video, false, fmt.Errorf("couldn't record source file: %w", err)
+	}
+
+	sourceURL := cfg.store.URL(sourceKey)
+	video.SourceURL = &sourceURL
+	return video, true, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const defaultGCGracePeriod = 24 * time.Hour
+
+type gcOrphan struct {
+	Store        string    `json:"store"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type gcReport struct {
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  time.Time  `json:"finished_at"`
+	DryRun      bool       `json:"dry_run"`
+	GracePeriod string     `json:"grace_period"`
+	Scanned     int        `json:"scanned"`
+	Referenced  int        `json:"referenced"`
+	TooRecent   int        `json:"too_recent"`
+	OrphanBytes int64      `json:"orphan_bytes"`
+	Orphans     []gcOrphan `json:"orphans"`
+}
+
+type gcTarget struct {
+	name  string
+	store storage.BlobStore
+}
+
+// gcTargets lists every place objects can live. With the S3 backend the
+// assets directory is scanned too, since thumbnails used to be written there.
+func (cfg *apiConfig) gcTargets() []gcTarget {
+	targets := []gcTarget{{name: cfg.storageBackend, store: cfg.store}}
+	if cfg.storageBackend != "local" {
+		legacy := storage.NewLocalStore(cfg.assetsRoot, fmt.Sprintf("http://localhost:%s/assets", cfg.port))
+		targets = append(targets, gcTarget{name: "assets", store: legacy})
+	}
+	return targets
+}
+
+// collectGarbage finds objects that no video references and, unless dryRun
+// is set, deletes the ones last modified before the grace period.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, grace time.Duration, dryRun bool) (gcReport, error) {
+	report := gcReport{
+		StartedAt:   time.Now().UTC(),
+		DryRun:      dryRun,
+		GracePeriod: grace.String(),
+		Orphans:     []gcOrphan{},
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return report, fmt.Errorf("couldn't load videos: %w", err)
+	}
+	assets, err := cfg.db.GetAllVideoAssets()
+	if err != nil {
+		return report, fmt.Errorf("couldn't load video assets: %w", err)
+	}
+	pendingKeys, err := cfg.db.GetPendingDeletionKeys()
+	if err != nil {
+		return report, fmt.Errorf("couldn't load pending deletions: %w", err)
+	}
+
+	videoIDs := map[uuid.UUID]bool{}
+	for _, video := range videos {
+		videoIDs[video.ID] = true
+	}
+
+	cutoff := report.StartedAt.Add(-grace)
+	for i, target := range cfg.gcTargets() {
+		keys := map[string]bool{}
+		prefixes := []string{}
+		for _, video := range videos {
+			for _, url := range []*string{video.VideoURL, video.ThumbnailURL} {
+				if key, ok := keyFromStoreURL(target.store, url); ok {
+					keys[key] = true
+				}
+			}
+		}
+		// Assets and the deletion outbox only ever refer to the main store.
+		if i == 0 {
+			for _, asset := range assets {
+				// Rows left behind by a job that outlived its video don't
+				// keep their objects alive.
+				if !videoIDs[asset.VideoID] {
+					continue
+				}
+				if asset.IsPrefix {
+					prefixes = append(prefixes, asset.Key)
+				} else {
+					keys[asset.Key] = true
+				}
+			}
+			// Queued keys may be prefixes, so match them as such.
+			prefixes = append(prefixes, pendingKeys...)
+		}
+
+		objects, err := target.store.List(ctx, "")
+		if err != nil {
+			return report, fmt.Errorf("couldn't list %s objects: %w", target.name, err)
+		}
+
+		for _, obj := range objects {
+			report.Scanned++
+			if keys[obj.Key] || hasAnyPrefix(obj.Key, prefixes) {
+				report.Referenced++
+				continue
+			}
+			if obj.LastModified.After(cutoff) {
+				report.TooRecent++
+				continue
+			}
+
+			orphan := gcOrphan{
+				Store:        target.name,
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			}
+			if !dryRun {
+				if err := target.store.Delete(ctx, obj.Key); err != nil {
+					orphan.Error = err.Error()
+				} else {
+					orphan.Deleted = true
+				}
+			}
+			report.OrphanBytes += obj.Size
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// runGCCommand implements `tubely gc`, printing the report as JSON.
+func (cfg *apiConfig) runGCCommand(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report orphaned objects without deleting them")
+	grace := flags.Duration("grace", defaultGCGracePeriod, "only consider objects older than this")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := cfg.collectGarbage(context.Background(), *grace, *dryRun)
+	if err != nil {
+		log.Printf("Garbage collection failed: %v", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Printf("Couldn't write report: %v", err)
+		return 1
+	}
+	for _, orphan := range report.Orphans {
+		if orphan.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runPeriodicGC collects garbage on a fixed interval while the server runs.
+func (cfg *apiConfig) runPeriodicGC(ctx context.Context, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := cfg.collectGarbage(ctx, grace, false)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+			continue
+		}
+		deleted := 0
+		for _, orphan := range report.Orphans {
+			if orphan.Deleted {
+				deleted++
+			}
+		}
+		log.Printf("Garbage collection: scanned %d objects, removed %d of %d orphans", report.Scanned, deleted, len(report.Orphans))
+	}
+}
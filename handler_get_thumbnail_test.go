@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerThumbnailGet(t *testing.T) {
+	cfg := newTestConfig(t)
+	video := createThumbnailVideo(t, cfg, []int{640}, []int{320, 640})
+	prefix := "thumbnails/" + video.ID.String() + "/v1/"
+	immutable := "public, max-age=31536000, immutable"
+
+	get := func(size, query string, header http.Header) *httptest.ResponseRecorder {
+		target := "/api/thumbnails/" + video.ID.String()
+		if size != "" {
+			target += "/" + size
+		}
+		r := httptest.NewRequest(http.MethodGet, target+query, nil)
+		r.SetPathValue("videoID", video.ID.String())
+		r.SetPathValue("size", size)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerThumbnailGet(w, r)
+		return w
+	}
+
+	first := get("", "", nil)
+	etag := first.Header().Get("ETag")
+	lastModified := first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("first response: status %d, ETag %q, Last-Modified %q", first.Code, etag, lastModified)
+	}
+
+	tests := []struct {
+		name        string
+		size        string
+		query       string
+		header      http.Header
+		wantStatus  int
+		wantBody    string
+		wantControl string
+	}{
+		{
+			name:        "largest rendition",
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "640.jpg",
+			wantControl: "public, no-cache",
+		},
+		{
+			name:        "current version is immutable",
+			query:       "?v=v1",
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "640.jpg",
+			wantControl: immutable,
+		},
+		{
+			name:        "outdated version revalidates",
+			query:       "?v=v0",
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "640.jpg",
+			wantControl: "public, no-cache",
+		},
+		{
+			name:        "width",
+			size:        "320w",
+			query:       "?v=v1",
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "320.jpg",
+			wantControl: immutable,
+		},
+		{
+			name:        "negotiated format",
+			header:      http.Header{"Accept": {"image/avif,image/webp"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "640.avif",
+			wantControl: "public, no-cache",
+		},
+		{
+			name:        "If-None-Match",
+			query:       "?v=v1",
+			header:      http.Header{"If-None-Match": {etag}},
+			wantStatus:  http.StatusNotModified,
+			wantControl: immutable,
+		},
+		{
+			name:        "If-None-Match for another format",
+			header:      http.Header{"If-None-Match": {etag}, "Accept": {"image/webp"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    prefix + "640.webp",
+			wantControl: "public, no-cache",
+		},
+		{
+			name:        "If-Modified-Since",
+			header:      http.Header{"If-Modified-Since": {lastModified}},
+			wantStatus:  http.StatusNotModified,
+			wantControl: "public, no-cache",
+		},
+		{
+			name:       "unknown width",
+			size:       "1280",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := get(tc.size, tc.query, tc.header)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if got := w.Body.String(); tc.wantBody != "" && got != tc.wantBody {
+				t.Errorf("body = %q, want %q", got, tc.wantBody)
+			}
+			if tc.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 response has a body of %d bytes", w.Body.Len())
+			}
+			if tc.wantControl != "" {
+				if got := w.Header().Get("Cache-Control"); got != tc.wantControl {
+					t.Errorf("Cache-Control = %q, want %q", got, tc.wantControl)
+				}
+				if got := w.Header().Get("Vary"); got != "Accept" {
+					t.Errorf("Vary = %q, want Accept", got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithVersionedThumbnailURLs(t *testing.T) {
+	cfg := newTestConfig(t)
+	video := createThumbnailVideo(t, cfg, []int{640}, []int{640})
+	stored := *video.ThumbnailURL
+	base := "/api/thumbnails/" + video.ID.String()
+
+	got := withVersionedThumbnailURLs(video)
+	if want := base + "?v=v1"; got.ThumbnailURL == nil || *got.ThumbnailURL != want {
+		t.Errorf("ThumbnailURL = %v, want %q", got.ThumbnailURL, want)
+	}
+	wantSrcset := base + "/320?v=v1 320w, " + base + "/640?v=v1 640w"
+	if got.ThumbnailSrcset == nil || *got.ThumbnailSrcset != wantSrcset {
+		t.Errorf("ThumbnailSrcset = %v, want %q", got.ThumbnailSrcset, wantSrcset)
+	}
+	if *video.ThumbnailURL != stored {
+		t.Errorf("the original video's ThumbnailURL changed to %q", *video.ThumbnailURL)
+	}
+
+	video.ThumbnailVersion = nil
+	if got := withVersionedThumbnailURLs(video); *got.ThumbnailURL != stored {
+		t.Errorf("unversioned ThumbnailURL = %q, want the stored %q", *got.ThumbnailURL, stored)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// frameExtractTimeout bounds how long ffmpeg may take to seek to and
+	// decode a frame before the request gives up.
+	frameExtractTimeout = time.Minute
+	// frameSourceExpiry is how long ffmpeg may keep reading the stored video.
+	frameSourceExpiry = 15 * time.Minute
+)
+
+// handlerThumbnailFromFrame makes a frame of the stored video the thumbnail.
+// The timestamp is either a number of seconds or a string like "1m30s" or
+// "25%".
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Timestamp any `json:"timestamp"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	videoData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to fetch video with matching ID", err)
+		return
+	}
+	if videoData.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if userID != videoData.UserID {
+		respondWithError(w, http.StatusForbidden, "You can't change the thumbnail of this video", nil)
+		return
+	}
+
+	if videoData.Metadata == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been processed yet", nil)
+		return
+	}
+	duration := time.Duration(videoData.Metadata.DurationSeconds * float64(time.Second))
+
+	at, err := frameTimestamp(params.Timestamp, duration)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videoKey, ok, err := cfg.currentAssetKey(videoData, assetKindVideo, videoData.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find stored video", err)
+		return
+	}
+	if !ok || path.Ext(videoKey) != ".mp4" {
+		respondWithError(w, http.StatusConflict, "Video has no stored file to take a frame from", nil)
+		return
+	}
+
+	// ffmpeg seeks in the stored file itself, so only the ranges around the
+	// frame are read instead of the whole video.
+	locator, ok := cfg.store.(storage.Locator)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage backend can't read frames in place", nil)
+		return
+	}
+	source, err := locator.Locate(r.Context(), videoKey, frameSourceExpiry)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusConflict, "Video has no stored file to take a frame from", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to find stored video", err)
+		return
+	}
+
+	frameFile, err := os.CreateTemp("", "tubely-frame-*.jpg")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to extract frame", err)
+		return
+	}
+	framePath := frameFile.Name()
+	frameFile.Close()
+	defer os.Remove(framePath)
+
+	extractCtx, cancel := context.WithTimeout(r.Context(), frameExtractTimeout)
+	defer cancel()
+	if err := extractFrame(extractCtx, source, framePath, at, ""); err != nil {
+		if errors.Is(extractCtx.Err(), context.DeadlineExceeded) {
+			respondWithError(w, http.StatusGatewayTimeout, "Timed out extracting frame", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Unable to extract frame", err)
+		return
+	}
+
+	frame, err := os.Open(framePath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to extract frame", err)
+		return
+	}
+	defer frame.Close()
+
+	videoData, _, err = cfg.storeThumbnail(r.Context(), videoData, frame, "image/jpeg", database.ThumbnailSourceFrame)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save thumbnail", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, withVersionedThumbnailURLs(videoData))
+}
+
+// frameTimestamp validates a requested frame position against the video's
+// duration.
+func frameTimestamp(value any, duration time.Duration) (time.Duration, error) {
+	var at time.Duration
+	switch v := value.(type) {
+	case float64:
+		at = time.Duration(v * float64(time.Second))
+	case string:
+		parsed, err := parseVideoPosition(v, duration)
+		if err != nil {
+			return 0, err
+		}
+		at = parsed
+	default:
+		return 0, fmt.Errorf("timestamp must be a number of seconds or a string like \"1m30s\"")
+	}
+	if at < 0 || (duration > 0 && at >= duration) {
+		return 0, fmt.Errorf("timestamp must be between 0 and %s", duration.Round(time.Millisecond))
+	}
+	return at, nil
+}
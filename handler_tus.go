@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxVideoUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusResumable enforces the protocol version header that every tus
+// request except OPTIONS must carry.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing or invalid Upload-Length", err)
+		return
+	}
+	if uploadLength > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is larger than 10 GB", nil)
+		return
+	}
+
+	if _, ok := parseTusMetadata(r.Header.Get("Upload-Metadata")); !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", nil)
+		return
+	}
+
+	videoData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to fetch video with matching ID", err)
+		return
+	}
+	if userID != videoData.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized to upload this video", nil)
+		return
+	}
+
+	upload, err := cfg.db.CreateTusUpload(database.CreateTusUploadParams{
+		VideoID:      videoID,
+		UserID:       userID,
+		UploadLength: uploadLength,
+		Metadata:     r.Header.Get("Upload-Metadata"),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	file, err := os.Create(cfg.tusUploadPath(upload.ID))
+	if err != nil {
+		cfg.db.DeleteTusUpload(upload.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	file.Close()
+	cfg.setVideoStatus(videoID, database.VideoStatusUploading, nil)
+
+	w.Header().Set("Location", "/api/tus/uploads/"+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.CreatedAt.Add(tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getOwnedTusUpload loads the upload named in the path and checks that it
+// belongs to the caller. It writes the error response itself.
+func (cfg *apiConfig) getOwnedTusUpload(w http.ResponseWriter, r *http.Request) (database.TusUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.TusUpload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.TusUpload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.TusUpload{}, false
+	}
+
+	upload, err := cfg.db.GetTusUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.TusUpload{}, false
+	}
+	if upload.ID == uuid.Nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.TusUpload{}, false
+	}
+	return upload, true
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getOwnedTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.Header().Set("Upload-Expires", upload.UpdatedAt.Add(tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Missing or invalid Upload-Offset", err)
+		return
+	}
+
+	upload, ok := cfg.getOwnedTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := cfg.tusLocks.lock(upload.ID)
+	defer unlock()
+
+	// Reload under the lock, another PATCH may have just finished.
+	upload, err = cfg.db.GetTusUpload(upload.ID)
+	if err != nil || upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+	if offset != upload.UploadOffset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	file, err := os.OpenFile(cfg.tusUploadPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer file.Close()
+
+	// Drop anything written after the last committed offset, e.g. by a
+	// request that was cut off before the offset was saved.
+	if err := file.Truncate(upload.UploadOffset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+	if _, err := file.Seek(upload.UploadOffset, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+
+	remaining := upload.UploadLength - upload.UploadOffset
+	report := cfg.progress.reporter(upload.VideoID, progressStageUpload)
+	body := &progressReader{
+		r:     io.LimitReader(r.Body, remaining),
+		total: upload.UploadLength,
+		report: func(current, total int64) {
+			report(upload.UploadOffset+current, total)
+		},
+	}
+	written, copyErr := io.Copy(file, body)
+	newOffset := upload.UploadOffset + written
+
+	// Keep whatever arrived, even if the connection dropped midway, so the
+	// client can resume from there.
+	if err := file.Sync(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload chunk", err)
+		return
+	}
+	if err := cfg.db.UpdateTusUploadOffset(upload.ID, newOffset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload chunk was interrupted", copyErr)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", time.Now().Add(tusUploadExpiry).UTC().Format(http.TimeFormat))
+
+	if newOffset < upload.UploadLength {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := probeUpload(r.Context(), file.Name()); err != nil {
+		var unsupported unsupportedVideoError
+		if errors.As(err, &unsupported) {
+			if err := cfg.removeTusUpload(upload.ID); err != nil {
+				log.Printf("Couldn't delete rejected upload %s: %v", upload.ID, err)
+			}
+			cfg.tusLocks.forget(upload.ID)
+			cfg.restoreVideoStatus(upload.VideoID)
+		}
+		respondWithUploadProbeError(w, err)
+		return
+	}
+
+	// The job owns the file from here on; only the upload record goes away.
+	_, err = cfg.queueVideoProcessing(upload.VideoID, upload.UserID, processVideoPayload{
+		SourcePath: file.Name(),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to queue video processing", err)
+		return
+	}
+	if err := cfg.db.DeleteTusUpload(upload.ID); err != nil {
+		log.Printf("Couldn't delete finished upload %s: %v", upload.ID, err)
+	}
+	cfg.tusLocks.forget(upload.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getOwnedTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := cfg.tusLocks.lock(upload.ID)
+	defer unlock()
+
+	if err := cfg.removeTusUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	cfg.restoreVideoStatus(upload.VideoID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) removeTusUpload(id uuid.UUID) error {
+	if err := os.Remove(cfg.tusUploadPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return cfg.db.DeleteTusUpload(id)
+}
@@ -1,17 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
-	"io"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -35,31 +29,30 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse multipart form", err)
+		return
+	}
 
-	file, header, err := r.FormFile("thumbnail")
+	file, _, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
 		return
 	}
 	defer file.Close()
 
-	mediaType := header.Header.Get("Content-Type")
-
-	checkedMediaType, _, err := mime.ParseMediaType(mediaType)
-	if checkedMediaType != "image/jpg" && checkedMediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Use only jpg or png", err)
+	// The part's Content-Type comes from the client's file name, so the
+	// image is identified by its magic bytes instead.
+	mediaType, image, err := sniffImage(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read image", err)
+		return
+	}
+	if _, ok := thumbnailExtensions[mediaType]; !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Use only jpg, png, webp or gif", fmt.Errorf("detected %s", mediaType))
 		return
 	}
-	// thumbnailFile, err := io.ReadAll(file)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Unable to read image", err)
-	// 	return
-	// }
 
 	videoData, err := cfg.db.GetVideo(videoID)
 	if err != nil {
@@ -72,42 +65,11 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	//newThumbnail := thumbnail{
-	//	data:      thumbnailFile,
-	//	mediaType: mediaType,
-	//}
-
-	// videoThumbnails[videoID] = newThumbnail
-
-	// thumbnailString := base64.StdEncoding.EncodeToString(thumbnailFile)
-	// dataURL := fmt.Sprintf("data:%s;base64,%s", mediaType, thumbnailString)
-
-	//newURL := fmt.Sprintf("http://localhost:%s/api/thumbnails/%s", cfg.port, videoIDString)
-
-	// Attempt at saving to disk
-	fileType := strings.TrimPrefix(mediaType, "image/")
-
-	// Generate new filename for each image
-	key := make([]byte, 32)
-	rand.Read(key)
-	// base64.URLEncoding.EncodeToString(key)
-
-	thumbnailFilename := fmt.Sprintf("%s.%s", base64.URLEncoding.EncodeToString(key), fileType)
-	newThumbnailPath := filepath.Join(cfg.assetsRoot, thumbnailFilename)
-	newFile, err := os.Create(newThumbnailPath)
-	if _, err := io.Copy(newFile, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to save image", err)
+	videoData, _, err = cfg.storeThumbnail(r.Context(), videoData, image, mediaType, database.ThumbnailSourceUpload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to save thumbnail", err)
 		return
 	}
 
-	newURL := fmt.Sprintf("http://localhost:%s/%s", cfg.port, newThumbnailPath)
-
-	videoData.ThumbnailURL = &newURL
-
-	videoUpdate := cfg.db.UpdateVideo(videoData)
-	if videoUpdate != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to update video thumbnail", videoUpdate)
-	}
-
-	respondWithJSON(w, http.StatusOK, videoData)
+	respondWithJSON(w, http.StatusOK, withVersionedThumbnailURLs(videoData))
 }
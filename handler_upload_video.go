@@ -1,33 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"context"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"log"
-	"mime"
 	"net/http"
 	"os"
-	"os/exec"
-	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
-type VideoInformation struct {
-	Data []StreamInfo `json:"streams"`
-}
-
-type StreamInfo struct {
-	AspectRatio string `json:"display_aspect_ratio"`
-}
-
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -48,27 +31,31 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fmt.Println("uploading video", videoID, "by user", userID)
+	r.Body = http.MaxBytesReader(w, struct {
+		io.Reader
+		io.Closer
+	}{&progressReader{
+		r:      r.Body,
+		total:  r.ContentLength,
+		report: cfg.progress.reporter(videoID, progressStageUpload),
+	}, r.Body}, maxVideoUploadSize)
 
-	const maxMemory = 10 << 30
-	r.ParseMultipartForm(maxMemory)
-	http.MaxBytesReader(w, r.Body, maxMemory)
+	// Parts larger than maxMemory are buffered on disk rather than in memory.
+	const maxMemory = 32 << 20
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse multipart form", err)
+		return
+	}
 
-	file, header, err := r.FormFile("video")
+	// The header's Content-Type isn't trusted: browsers often have none for
+	// MKV, and the file is identified by ffprobe once it's received.
+	file, _, err := r.FormFile("video")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
 		return
 	}
 	defer file.Close()
 
-	mediaType := header.Header.Get("Content-Type")
-
-	checkedMediaType, _, err := mime.ParseMediaType(mediaType)
-	if checkedMediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Use only mp4", err)
-		return
-	}
-
 	videoData, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to fetch video with matching ID", err)
@@ -80,124 +67,50 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	//videoFile, err := os.CreateTemp("", "tubely-upload.mp4")
-	videoFile, err := os.CreateTemp("/tmp/", "tubely-upload.mp4")
+	cfg.setVideoStatus(videoID, database.VideoStatusUploading, nil)
+
+	videoFile, err := cfg.newSpoolFile()
 	if err != nil {
+		cfg.restoreVideoStatus(videoID)
 		respondWithError(w, http.StatusInternalServerError, "Unable to create file storage", err)
 		return
 	}
-	defer os.Remove(videoFile.Name()) // clean up
 	defer videoFile.Close()
 
 	if _, err := io.Copy(videoFile, file); err != nil {
+		os.Remove(videoFile.Name())
+		cfg.restoreVideoStatus(videoID)
 		respondWithError(w, http.StatusInternalServerError, "Unable to save video", err)
 		return
 	}
 
-	videoFile.Seek(0, io.SeekStart)
-
-	aspect, err := getVideoAspectRatio(videoFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to fetch aspect ratio", err)
+	if _, err := probeUpload(r.Context(), videoFile.Name()); err != nil {
+		os.Remove(videoFile.Name())
+		cfg.restoreVideoStatus(videoID)
+		respondWithUploadProbeError(w, err)
 		return
 	}
 
-	fastProcessed, err := processVideoForFastStart(videoFile.Name())
+	job, err := cfg.queueVideoProcessing(videoID, userID, processVideoPayload{
+		SourcePath: videoFile.Name(),
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to update processing bit", err)
+		os.Remove(videoFile.Name())
+		cfg.restoreVideoStatus(videoID)
+		respondWithError(w, http.StatusInternalServerError, "Unable to queue video processing", err)
 		return
 	}
 
-	fastProcessedVideoFile, err := os.Open(fastProcessed)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to open processed video", err)
-		return
-	}
-	defer os.Remove(fastProcessedVideoFile.Name()) // clean up
-	defer fastProcessedVideoFile.Close()
-
-	fileType := strings.TrimPrefix(mediaType, "video/")
-
-	// Generate new filename for each image
-	key := make([]byte, 32)
-	rand.Read(key)
-	// base64.URLEncoding.EncodeToString(key)
-	var aspectString string
-	if aspect == "16:9" {
-		aspectString = "landscape"
-	} else if aspect == "9:16" {
-		aspectString = "portrait"
-	} else {
-		aspectString = "other"
-	}
-	videoFilename := fmt.Sprintf("%s/%s.%s", aspectString, base64.URLEncoding.EncodeToString(key), fileType)
-
-	awsObject := s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &videoFilename,
-		Body:        fastProcessedVideoFile,
-		ContentType: &checkedMediaType,
-	}
-
-	_, videoUploadErr := cfg.s3client.PutObject(context.Background(), &awsObject)
-	if videoUploadErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to upload video to AWS", videoUploadErr)
-		return
-	}
-
-	newURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, videoFilename)
-	//newURL := fmt.Sprintf("%s,%s", cfg.s3Bucket, videoFilename)
-
-	videoData.VideoURL = &newURL
-
-	videoUpdate := cfg.db.UpdateVideo(videoData)
-	if videoUpdate != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to update video url", videoUpdate)
-		return
-	}
-
-	respondWithJSON(w, http.StatusOK, videoData)
+	respondWithJSON(w, http.StatusAccepted, job)
 }
 
-func getVideoAspectRatio(filepath string) (string, error) {
-	ffProbe := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filepath)
-	var ffProbeOut bytes.Buffer
-	ffProbe.Stdout = &ffProbeOut
-
-	err := ffProbe.Run()
-	if err != nil {
-		log.Println(err)
-		return "", fmt.Errorf("")
-	}
-
-	decoder := json.NewDecoder(&ffProbeOut)
-	results := VideoInformation{}
-	videoSuccess := decoder.Decode(&results)
-	if videoSuccess != nil {
-		return "", videoSuccess
-	}
-	if len(results.Data) < 1 {
-		return "", fmt.Errorf("Video data set empty")
-	}
-
-	if results.Data[0].AspectRatio != "16:9" && results.Data[0].AspectRatio != "9:16" {
-		return "other", nil
-	}
-
-	return results.Data[0].AspectRatio, nil
-}
-
-func processVideoForFastStart(filepath string) (string, error) {
-	outputFilepath := fmt.Sprintf("%s.processing", filepath)
-	ffmpeg := exec.Command("ffmpeg", "-i", filepath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilepath)
-	var ffmpegOut bytes.Buffer
-	ffmpeg.Stdout = &ffmpegOut
-
-	err := ffmpeg.Run()
-	if err != nil {
-		log.Println(err)
-		return "", fmt.Errorf("")
+// respondWithUploadProbeError answers 415 for files probeUpload rejected and
+// 500 when the file couldn't be checked at all.
+func respondWithUploadProbeError(w http.ResponseWriter, err error) {
+	var unsupported unsupportedVideoError
+	if errors.As(err, &unsupported) {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported video: "+unsupported.reason, err)
+		return
 	}
-
-	return outputFilepath, nil
+	respondWithError(w, http.StatusInternalServerError, "Unable to check video", err)
 }
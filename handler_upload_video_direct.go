@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	maxVideoUploadSize       = 10 << 30
+	presignExpiry            = time.Hour
+	directUploadPartSize     = 64 << 20
+	directMultipartThreshold = 100 << 20
+	maxMultipartParts        = 10000
+
+	// directUploadExpiry leaves time to complete a multipart upload whose
+	// parts were sent just before their URLs expired.
+	directUploadExpiry = 2 * presignExpiry
+)
+
+// directUploadPrefix is where clients upload raw files before processing.
+// Anything left there is cleaned up by gc once the grace period passes.
+func directUploadPrefix(videoID uuid.UUID) string {
+	return "uploads/" + videoID.String()
+}
+
+func (cfg *apiConfig) handlerUploadVideoPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+	type presignedPart struct {
+		PartNumber int32 `json:"part_number"`
+		Size       int64 `json:"size"`
+		storage.PresignedRequest
+	}
+	type response struct {
+		Key      string                    `json:"key"`
+		UploadID string                    `json:"upload_id,omitempty"`
+		PartSize int64                     `json:"part_size,omitempty"`
+		Upload   *storage.PresignedRequest `json:"upload,omitempty"`
+		Parts    []presignedPart           `json:"parts,omitempty"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploader, ok := cfg.store.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Only used for the staged object; processing checks the actual
+	// container with ffprobe.
+	checkedMediaType := "application/octet-stream"
+	if params.ContentType != "" {
+		checkedMediaType, _, err = mime.ParseMediaType(params.ContentType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid content_type", err)
+			return
+		}
+	}
+	if params.Size <= 0 || params.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusBadRequest, "Video size must be between 1 byte and 10 GB", nil)
+		return
+	}
+
+	videoData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to fetch video with matching ID", err)
+		return
+	}
+	if userID != videoData.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized to upload this video", nil)
+		return
+	}
+
+	key := newAssetKey(directUploadPrefix(videoID), "upload")
+	cfg.setVideoStatus(videoID, database.VideoStatusUploading, nil)
+
+	if params.Size < directMultipartThreshold {
+		upload, err := uploader.PresignPut(r.Context(), key, checkedMediaType, params.Size, presignExpiry)
+		if err != nil {
+			cfg.restoreVideoStatus(videoID)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, response{
+			Key:    key,
+			Upload: &upload,
+		})
+		return
+	}
+
+	partSize := int64(directUploadPartSize)
+	for (params.Size+partSize-1)/partSize > maxMultipartParts {
+		partSize *= 2
+	}
+
+	uploadID, err := uploader.CreateMultipartUpload(r.Context(), key, checkedMediaType)
+	if err != nil {
+		cfg.restoreVideoStatus(videoID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start multipart upload", err)
+		return
+	}
+
+	parts := []presignedPart{}
+	for offset, partNumber := int64(0), int32(1); offset < params.Size; offset, partNumber = offset+partSize, partNumber+1 {
+		size := min(partSize, params.Size-offset)
+		req, err := uploader.PresignUploadPart(r.Context(), key, uploadID, partNumber, size, presignExpiry)
+		if err != nil {
+			uploader.AbortMultipartUpload(r.Context(), key, uploadID)
+			cfg.restoreVideoStatus(videoID)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload part", err)
+			return
+		}
+		parts = append(parts, presignedPart{
+			PartNumber:       partNumber,
+			Size:             size,
+			PresignedRequest: req,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Key:      key,
+		UploadID: uploadID,
+		PartSize: partSize,
+		Parts:    parts,
+	})
+}
+
+func (cfg *apiConfig) handlerUploadVideoComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key      string                  `json:"key"`
+		UploadID string                  `json:"upload_id"`
+		Parts    []storage.CompletedPart `json:"parts"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploader, ok := cfg.store.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, directUploadPrefix(videoID)+"/") {
+		respondWithError(w, http.StatusBadRequest, "Upload key doesn't belong to this video", nil)
+		return
+	}
+
+	videoData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to fetch video with matching ID", err)
+		return
+	}
+	if userID != videoData.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized to upload this video", nil)
+		return
+	}
+
+	// A retried request for an upload that is already queued gets the same
+	// job back instead of queueing the object twice.
+	active, err := cfg.db.GetActiveJob(videoID, jobKindProcessVideo)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video jobs", err)
+		return
+	}
+	if active != nil {
+		respondWithActiveJob(w, *active, params.Key)
+		return
+	}
+
+	if params.UploadID != "" {
+		err = uploader.CompleteMultipartUpload(r.Context(), params.Key, params.UploadID, params.Parts)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't complete multipart upload", err)
+			return
+		}
+	}
+
+	// Processing deletes the object once it is done, so a key that isn't
+	// there was either never uploaded or has already been processed.
+	_, err = cfg.store.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusConflict, "Upload not found, it may already have been processed", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded video", err)
+		return
+	}
+
+	job, err := cfg.queueVideoProcessingOnce(videoID, userID, processVideoPayload{
+		SourceKey: params.Key,
+	})
+	if errors.Is(err, database.ErrJobActive) {
+		active, err := cfg.db.GetActiveJob(videoID, jobKindProcessVideo)
+		if err != nil || active == nil {
+			respondWithError(w, http.StatusConflict, "Video is already being processed", err)
+			return
+		}
+		respondWithActiveJob(w, *active, params.Key)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to queue video processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// respondWithActiveJob answers a complete request for a video that is
+// already being processed: with the job itself if it processes key, and
+// with a conflict if it processes another upload.
+func respondWithActiveJob(w http.ResponseWriter, job database.Job, key string) {
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err == nil && payload.SourceKey == key {
+		respondWithJSON(w, http.StatusAccepted, job)
+		return
+	}
+	respondWithError(w, http.StatusConflict, "Video is already being processed", nil)
+}
+
+// runDirectUploadExpiry puts videos whose direct upload was presigned but
+// never completed back to their previous status once the presigned URLs
+// can no longer be used. The staged object, if any, is left to gc.
+func (cfg *apiConfig) runDirectUploadExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := cfg.db.GetStaleUploadingVideos(time.Now().Add(-directUploadExpiry))
+		if err != nil {
+			log.Printf("Couldn't load stale uploads: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			log.Printf("Upload of video %s was never completed", id)
+			cfg.restoreVideoStatus(id)
+		}
+	}
+}
+
+func (cfg *apiConfig) handlerUploadVideoAbort(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key      string `json:"key"`
+		UploadID string `json:"upload_id"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	uploader, ok := cfg.store.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, directUploadPrefix(videoID)+"/") {
+		respondWithError(w, http.StatusBadRequest, "Upload key doesn't belong to this video", nil)
+		return
+	}
+
+	videoData, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to fetch video with matching ID", err)
+		return
+	}
+	if userID != videoData.UserID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized to upload this video", nil)
+		return
+	}
+
+	if params.UploadID != "" {
+		err = uploader.AbortMultipartUpload(r.Context(), params.Key, params.UploadID)
+	} else {
+		err = cfg.store.Delete(r.Context(), params.Key)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't abort upload", err)
+		return
+	}
+	cfg.restoreVideoStatus(videoID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const eventsKeepAlive = 15 * time.Second
+
+// handlerVideoEventsTicket issues a ticket for opening the video's event
+// stream with EventSource, which can't set headers. The JWT itself never
+// goes into a URL, where logs and browser history would keep it.
+func (cfg *apiConfig) handlerVideoEventsTicket(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't watch this video's progress", nil)
+		return
+	}
+
+	ticket, expiresAt, err := cfg.eventsTickets.issue(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't issue ticket", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusCreated, response{Ticket: ticket, ExpiresAt: expiresAt})
+}
+
+// handlerVideoEvents streams a video's upload, transcode and storage progress
+// as server-sent events. It takes the JWT in the Authorization header or a
+// ticket from handlerVideoEventsTicket as ?ticket=.
+func (cfg *apiConfig) handlerVideoEvents(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		if !cfg.eventsTickets.redeem(ticket, videoID) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid or expired ticket", nil)
+			return
+		}
+	} else {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil || video.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+			return
+		}
+		if video.UserID != userID {
+			respondWithError(w, http.StatusForbidden, "You can't watch this video's progress", nil)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+
+	// Read the status once subscribed: a change made before the
+	// subscription would otherwise never reach the client.
+	events, unsubscribe := cfg.progress.subscribe(videoID)
+	defer unsubscribe()
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	writeEvent(w, progressEvent{
+		VideoID:       video.ID,
+		Stage:         progressStageStatus,
+		Status:        video.Status,
+		FailureReason: video.FailureReason,
+	})
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			writeEvent(w, ev)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev progressEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Stage, data)
+}
@@ -2,7 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -33,6 +39,10 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	if params.KeepVersions < 0 {
+		respondWithError(w, http.StatusBadRequest, "keep_versions can't be negative", nil)
+		return
+	}
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -72,11 +82,41 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	legacyKeys := []string{}
+	for _, url := range []*string{video.VideoURL, video.ThumbnailURL} {
+		if key, ok := cfg.storageKeyFromURL(url); ok {
+			legacyKeys = append(legacyKeys, key)
+		}
+	}
+
+	deleted, err := cfg.db.DeleteVideoAndQueueObjects(videoID, legacyKeys, jobSourceObjects)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.runningJobs.cancelVideo(videoID)
+	for _, job := range deleted.Jobs {
+		removeJobSpoolFile(job)
+	}
+	for _, id := range deleted.TusUploads {
+		if err := os.Remove(cfg.tusUploadPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't remove upload %s of deleted video %s: %v", id, videoID, err)
+		}
+		cfg.tusLocks.forget(id)
+	}
+
+	failed := cfg.purgePendingDeletions(r.Context(), deleted.Pending)
+	if len(failed) > 0 {
+		type response struct {
+			Message     string   `json:"message"`
+			PendingKeys []string `json:"pending_keys"`
+		}
+		respondWithJSON(w, http.StatusAccepted, response{
+			Message:     "Video deleted, but some stored files couldn't be removed yet and will be retried",
+			PendingKeys: failed,
+		})
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -95,7 +135,7 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusOK, withVersionedThumbnailURLs(video))
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -110,11 +150,97 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	filter, err := parseVideoFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID, filter)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
+	for i := range videos {
+		videos[i] = withVersionedThumbnailURLs(videos[i])
+	}
 	respondWithJSON(w, http.StatusOK, videos)
 }
+
+func (cfg *apiConfig) handlerVideoStatusGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		ID            uuid.UUID `json:"id"`
+		Status        string    `json:"status"`
+		FailureReason *string   `json:"failure_reason"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, response{
+		ID:            video.ID,
+		Status:        video.Status,
+		FailureReason: video.FailureReason,
+		UpdatedAt:     video.UpdatedAt,
+	})
+}
+
+// parseVideoFilter reads the optional filters of GET /api/videos, e.g.
+// ?min_duration=60&video_codec=h264&container=mp4.
+func parseVideoFilter(query url.Values) (database.VideoFilter, error) {
+	filter := database.VideoFilter{
+		Status:     query.Get("status"),
+		VideoCodec: query.Get("video_codec"),
+		AudioCodec: query.Get("audio_codec"),
+		Container:  query.Get("container"),
+	}
+
+	floats := map[string]**float64{
+		"min_duration": &filter.MinDuration,
+		"max_duration": &filter.MaxDuration,
+	}
+	for name, dest := range floats {
+		if value := query.Get(name); value != "" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 {
+				return filter, fmt.Errorf("%s must be a non-negative number of seconds", name)
+			}
+			*dest = &f
+		}
+	}
+
+	ints := map[string]**int{
+		"min_width":  &filter.MinWidth,
+		"max_width":  &filter.MaxWidth,
+		"min_height": &filter.MinHeight,
+		"max_height": &filter.MaxHeight,
+	}
+	for name, dest := range ints {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*dest = &n
+		}
+	}
+
+	return filter, nil
+}
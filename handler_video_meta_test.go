@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestParseVideoFilter(t *testing.T) {
+	zero, seconds := 0.0, 90.5
+	zeroInt, hd := 0, 720
+
+	tests := []struct {
+		name    string
+		query   string
+		want    database.VideoFilter
+		wantErr bool
+	}{
+		{name: "empty", query: ""},
+		{
+			name:  "strings",
+			query: "status=ready&video_codec=h264&audio_codec=aac&container=mp4",
+			want:  database.VideoFilter{Status: "ready", VideoCodec: "h264", AudioCodec: "aac", Container: "mp4"},
+		},
+		{
+			name:  "zero bounds",
+			query: "min_duration=0&max_duration=0&min_width=0&max_width=0&min_height=0&max_height=0",
+			want: database.VideoFilter{
+				MinDuration: &zero, MaxDuration: &zero,
+				MinWidth: &zeroInt, MaxWidth: &zeroInt,
+				MinHeight: &zeroInt, MaxHeight: &zeroInt,
+			},
+		},
+		{
+			name:  "bounds",
+			query: "max_duration=90.5&min_height=720",
+			want:  database.VideoFilter{MaxDuration: &seconds, MinHeight: &hd},
+		},
+		{name: "empty value", query: "max_width=", want: database.VideoFilter{}},
+		{name: "negative duration", query: "min_duration=-1", wantErr: true},
+		{name: "duration not a number", query: "max_duration=long", wantErr: true},
+		{name: "negative width", query: "max_width=-5", wantErr: true},
+		{name: "fractional height", query: "min_height=720.5", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseVideoFilter(query)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseVideoFilter(%q) = %+v, want an error", tc.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoFilter(%q) error = %v", tc.query, err)
+			}
+			if got, want := formatVideoFilter(got), formatVideoFilter(tc.want); got != want {
+				t.Errorf("parseVideoFilter(%q) = %s, want %s", tc.query, got, want)
+			}
+		})
+	}
+}
+
+// formatVideoFilter prints the bounds' values rather than their addresses.
+func formatVideoFilter(f database.VideoFilter) string {
+	format := func(v any) string {
+		switch p := v.(type) {
+		case *float64:
+			if p != nil {
+				return fmt.Sprint(*p)
+			}
+		case *int:
+			if p != nil {
+				return fmt.Sprint(*p)
+			}
+		}
+		return "nil"
+	}
+	return fmt.Sprintf("{status=%q duration=[%s,%s] width=[%s,%s] height=[%s,%s] video_codec=%q audio_codec=%q container=%q}",
+		f.Status,
+		format(f.MinDuration), format(f.MaxDuration),
+		format(f.MinWidth), format(f.MaxWidth),
+		format(f.MinHeight), format(f.MaxHeight),
+		f.VideoCodec, f.AudioCodec, f.Container)
+}
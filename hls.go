@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	assetKindHLS      = "hls"
+	hlsMasterPlaylist = "master.m3u8"
+)
+
+// packageHLS segments the encoded renditions into outDir without
+// re-encoding:
+//
+//	master.m3u8
+//	720p/index.m3u8
+//	720p/segment_00000.ts
+func packageHLS(ctx context.Context, files []string, renditions []rendition, hasAudio bool, outDir string, segmentTime time.Duration) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	args := []string{"-v", "error", "-y"}
+	for _, file := range files {
+		args = append(args, "-i", file)
+	}
+	streamMap := []string{}
+	for i, r := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+		entry := fmt.Sprintf("v:%d,name:%s", i, r.name())
+		if hasAudio {
+			args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+			entry = fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.name())
+		}
+		streamMap = append(streamMap, entry)
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", formatSeconds(segmentTime),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", filepath.Join(outDir, "%v", "segment_%05d.ts"),
+		"-master_pl_name", hlsMasterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outDir, "%v", "index.m3u8"),
+	)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// acceptsMediaType reports whether an Accept header explicitly lists
+// mediaType with a non-zero quality. Wildcards don't count: browsers send
+// "image/*" whether or not they can decode AVIF.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				q, err := strconv.ParseFloat(value, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// negotiateThumbnailFormat serves the AVIF or WebP version of a JPEG or PNG
+// thumbnail rendition when the request's Accept header asks for it. The
+// variants are looked up in the video's thumbnail sources, like
+// /api/thumbnails does, rather than on disk. Thumbnail URLs keep pointing at
+// the fallback, so caches are told the response depends on Accept.
+func (cfg *apiConfig) negotiateThumbnailFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		ext := path.Ext(name)
+		if !strings.HasPrefix(name, "/thumbnails/") || (ext != ".jpg" && ext != ".png") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+		if key, ok := cfg.negotiatedThumbnailKey(strings.TrimPrefix(name, "/"), r.Header.Get("Accept")); ok {
+			negotiated := r.Clone(r.Context())
+			negotiated.URL.Path = "/" + key
+			next.ServeHTTP(w, negotiated)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiatedThumbnailKey returns the key of the preferred format of the
+// rendition stored at key, which is "thumbnails/<videoID>/...". ok is false
+// when the fallback should be served: the key isn't one of its video's
+// current renditions, or none of the other formats is accepted.
+func (cfg *apiConfig) negotiatedThumbnailKey(key, accept string) (string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 {
+		return "", false
+	}
+	videoID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return "", false
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil {
+		return "", false
+	}
+
+	for width, url := range video.Thumbnails {
+		if fallbackKey, ok := cfg.storageKeyFromURL(&url); !ok || fallbackKey != key {
+			continue
+		}
+		preferred := preferredThumbnailURL(video, width, accept)
+		preferredKey, ok := cfg.storageKeyFromURL(&preferred)
+		return preferredKey, ok && preferredKey != key
+	}
+	return "", false
+}
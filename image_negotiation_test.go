@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   bool
+	}{
+		{"listed", "image/avif", true},
+		{"listed among others", "image/webp,image/avif,image/apng", true},
+		{"browser default", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", true},
+		{"case and spaces", " Image/AVIF ; q=0.5", true},
+		{"q=0", "image/avif;q=0", false},
+		{"q=0.0 with spaces", "image/webp, image/avif ; q=0.0", false},
+		{"q after other params", "image/avif;level=1;q=0", false},
+		{"invalid q", "image/avif;q=high", false},
+		{"image wildcard", "image/*", false},
+		{"any wildcard", "*/*", false},
+		{"other type", "image/webp", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acceptsMediaType(tc.accept, "image/avif"); got != tc.want {
+				t.Errorf("acceptsMediaType(%q, image/avif) = %v, want %v", tc.accept, got, tc.want)
+			}
+		})
+	}
+}
+
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	assetsRoot := t.TempDir()
+	return &apiConfig{
+		db:               db,
+		jwtSecret:        "secret",
+		assetsRoot:       assetsRoot,
+		store:            storage.NewLocalStore(assetsRoot, "http://localhost:8091/assets"),
+		thumbnailFormats: []string{"avif", "webp"},
+	}
+}
+
+// createThumbnailVideo creates a video with 320 and 640 pixel JPEG
+// renditions and AVIF and WebP versions of the given widths. Every stored
+// object holds its own key.
+func createThumbnailVideo(t *testing.T, cfg *apiConfig, avifWidths, webpWidths []int) database.Video {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo() error = %v", err)
+	}
+
+	prefix := path.Join("thumbnails", video.ID.String(), "v1")
+	store := func(width int, ext string) string {
+		key := fmt.Sprintf("%s/%d.%s", prefix, width, ext)
+		if err := cfg.store.Put(context.Background(), key, strings.NewReader(key), contentTypeForKey(key)); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+		return cfg.store.URL(key)
+	}
+	source := func(ext string, widths []int) database.ThumbnailSource {
+		sizes := map[int]string{}
+		for _, width := range widths {
+			sizes[width] = store(width, ext)
+		}
+		return database.ThumbnailSource{Type: contentTypeForKey("." + ext), Sizes: sizes, Srcset: *database.ThumbnailSrcset(sizes)}
+	}
+
+	params := database.SetVideoThumbnailParams{
+		Source:  database.ThumbnailSourceUpload,
+		Sizes:   map[int]string{320: store(320, "jpg"), 640: store(640, "jpg")},
+		Sources: []database.ThumbnailSource{source("avif", avifWidths), source("webp", webpWidths)},
+		Version: "v1",
+	}
+	params.URL = params.Sizes[640]
+	if _, err := cfg.db.SetVideoThumbnail(video.ID, params, false); err != nil {
+		t.Fatalf("SetVideoThumbnail() error = %v", err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo() error = %v", err)
+	}
+	return video
+}
+
+func TestNegotiateThumbnailFormat(t *testing.T) {
+	cfg := newTestConfig(t)
+	video := createThumbnailVideo(t, cfg, []int{640}, []int{320, 640})
+	handler := cfg.negotiateThumbnailFormat(http.FileServer(http.Dir(cfg.assetsRoot)))
+	prefix := "thumbnails/" + video.ID.String() + "/v1/"
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		want   string
+	}{
+		{"avif preferred", "640.jpg", "image/avif,image/webp,*/*", "640.avif"},
+		{"sources order beats accept order", "640.jpg", "image/webp,image/avif", "640.avif"},
+		{"webp", "640.jpg", "image/webp", "640.webp"},
+		{"avif refused", "640.jpg", "image/avif;q=0,image/webp", "640.webp"},
+		{"no avif at this width", "320.jpg", "image/avif,image/webp", "320.webp"},
+		{"wildcards only", "640.jpg", "image/*,*/*", "640.jpg"},
+		{"no accept", "320.jpg", "", "320.jpg"},
+		{"not a current rendition", "1280.jpg", "image/avif", ""},
+		{"not a fallback", "640.webp", "image/avif", "640.webp"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+prefix+tc.path, nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if tc.want == "" {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+				}
+				return
+			}
+			if got := w.Body.String(); got != prefix+tc.want {
+				t.Errorf("served %q, want %q", got, prefix+tc.want)
+			}
+			if path.Ext(tc.path) == ".jpg" && w.Header().Get("Vary") != "Accept" {
+				t.Errorf("Vary = %q, want Accept", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Package blurhash encodes images as BlurHash strings, a few dozen
+// characters that decode to a blurred placeholder of the image. See
+// https://blurha.sh for the format.
+package blurhash
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+var ErrInvalidComponents = errors.New("blurhash components must be between 1 and 9")
+
+var ErrEmptyImage = errors.New("blurhash needs a non-empty image")
+
+// Encode computes the BlurHash of img with xComponents by yComponents
+// cosine components. More components keep more detail at the cost of a
+// longer string; 4x3 is a common choice for landscape images.
+func Encode(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", ErrInvalidComponents
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", ErrEmptyImage
+	}
+
+	// Convert every pixel to linear RGB once instead of once per component.
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(r >> 8),
+				sRGBToLinear(g >> 8),
+				sRGBToLinear(b >> 8),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			factors = append(factors, multiplyBasis(linear, width, height, i, j))
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, factor := range ac {
+			for _, value := range factor {
+				actualMax = math.Max(actualMax, math.Abs(value))
+			}
+		}
+		quantisedMax := clamp(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encode83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	hash.WriteString(encode83(encodeDC(dc), 4))
+	for _, factor := range ac {
+		hash.WriteString(encode83(encodeAC(factor, maxValue), 2))
+	}
+	return hash.String(), nil
+}
+
+// multiplyBasis projects the image onto the cosine basis function (i, j).
+func multiplyBasis(linear [][3]float64, width, height, i, j int) [3]float64 {
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+	var sum [3]float64
+	for y := 0; y < height; y++ {
+		basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+		for x := 0; x < width; x++ {
+			basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * basisY
+			pixel := linear[y*width+x]
+			sum[0] += basis * pixel[0]
+			sum[1] += basis * pixel[1]
+			sum[2] += basis * pixel[2]
+		}
+	}
+	scale := normalisation / float64(width*height)
+	return [3]float64{sum[0] * scale, sum[1] * scale, sum[2] * scale}
+}
+
+func encodeDC(value [3]float64) int {
+	return linearToSRGB(value[0])<<16 + linearToSRGB(value[1])<<8 + linearToSRGB(value[2])
+}
+
+func encodeAC(value [3]float64, maxValue float64) int {
+	quant := func(v float64) int {
+		return clamp(int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+	}
+	return quant(value[0])*19*19 + quant(value[1])*19 + quant(value[2])
+}
+
+func encode83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clamp(value, low, high int) int {
+	return max(low, min(high, value))
+}
@@ -0,0 +1,135 @@
+package blurhash
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func solidImage(width, height int, c color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// gradientImage runs red left to right and green top to bottom.
+func gradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / (width - 1)), uint8(y * 255 / (height - 1)), 128, 255})
+		}
+	}
+	return img
+}
+
+func checkerImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if (x+y)%2 == 0 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// The expected hashes are what the reference TypeScript encoder
+// (github.com/woltapp/blurhash) produces for the same pixels.
+func TestEncode(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	tests := []struct {
+		name        string
+		img         image.Image
+		xComponents int
+		yComponents int
+		want        string
+	}{
+		{"black", solidImage(8, 6, color.RGBA{0, 0, 0, 255}), 4, 3, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"white", solidImage(8, 6, color.RGBA{255, 255, 255, 255}), 4, 3, "LsTSUA_3fQ_3~qt7fQt7fQfQfQfQ"},
+		{"dc only", solidImage(8, 6, color.RGBA{200, 100, 50, 255}), 1, 1, "00M|T9"},
+		{"1x1 image dc only", solidImage(1, 1, red), 1, 1, "00TI:j"},
+		{"1x1 image", solidImage(1, 1, red), 4, 3, "L~TI:j|c|c|c|c|c|c|c|c|c|c|c"},
+		{"gradient", gradientImage(32, 24), 4, 3, "L$HewF2swxX8l}WDjte;gJfjfQfj"},
+		{"gradient 9x1", gradientImage(32, 24), 9, 1, "8$HewF2swxX8a|ofWpofWp"},
+		{"gradient 1x9", gradientImage(32, 24), 1, 9, "=$HewFl}gJn,e;ofeqoyeq"},
+		{"gradient 9x9", gradientImage(32, 24), 9, 9, "|$HewF2swxX8a|ofWpofWpl}WDjte;fQe;fQe;fQgJfjfQfjfQfjfQfjfQn,WpjtfQfQfQfQfQfQe;fQfQfQfQfQfQfQfQofWpjtfQfQfQfQfQfQeqfQfQfQfQfQfQfQfQoyWpjtfQfQfQfQfQfQeqfQfQfQfQfQfQfQfQ"},
+		{"checker", checkerImage(4, 4), 2, 2, "AfLqe9~q~q-;"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Encode(tc.img, tc.xComponents, tc.yComponents)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Encode() = %q, want %q", got, tc.want)
+			}
+			if wantLen := 4 + 2*tc.xComponents*tc.yComponents; len(got) != wantLen {
+				t.Errorf("len(Encode()) = %d, want %d", len(got), wantLen)
+			}
+		})
+	}
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	// Bounds that don't start at the origin must hash like the same pixels
+	// copied to their own image.
+	outer := gradientImage(64, 48)
+	sub := outer.SubImage(image.Rect(16, 12, 48, 36))
+	copied := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			copied.Set(x, y, outer.At(16+x, 12+y))
+		}
+	}
+
+	got, err := Encode(sub, 4, 3)
+	if err != nil {
+		t.Fatalf("Encode(sub) error = %v", err)
+	}
+	want, err := Encode(copied, 4, 3)
+	if err != nil {
+		t.Fatalf("Encode(copied) error = %v", err)
+	}
+	if got != want {
+		t.Errorf("Encode(sub) = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	img := solidImage(4, 4, color.RGBA{0, 0, 0, 255})
+	tests := []struct {
+		name        string
+		img         image.Image
+		xComponents int
+		yComponents int
+		want        error
+	}{
+		{"zero x components", img, 0, 3, ErrInvalidComponents},
+		{"zero y components", img, 4, 0, ErrInvalidComponents},
+		{"negative components", img, -1, -1, ErrInvalidComponents},
+		{"ten x components", img, 10, 3, ErrInvalidComponents},
+		{"ten y components", img, 4, 10, ErrInvalidComponents},
+		{"empty image", image.NewRGBA(image.Rect(0, 0, 0, 0)), 4, 3, ErrEmptyImage},
+		{"zero width", image.NewRGBA(image.Rect(0, 0, 0, 5)), 4, 3, ErrEmptyImage},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Encode(tc.img, tc.xComponents, tc.yComponents)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Encode() error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
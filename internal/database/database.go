@@ -72,9 +72,184 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	_, err = c.addColumnIfMissing("videos", "keep_versions", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	addedStatus, err := c.addColumnIfMissing("videos", "status", "TEXT NOT NULL DEFAULT 'draft'")
+	if err != nil {
+		return err
+	}
+	if addedStatus {
+		_, err = c.db.Exec("UPDATE videos SET status = ? WHERE video_url IS NOT NULL", VideoStatusReady)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = c.addColumnIfMissing("videos", "failure_reason", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "dash_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	addedThumbnailSource, err := c.addColumnIfMissing("videos", "thumbnail_source", "TEXT")
+	if err != nil {
+		return err
+	}
+	if addedThumbnailSource {
+		_, err = c.db.Exec("UPDATE videos SET thumbnail_source = ? WHERE thumbnail_url IS NOT NULL", ThumbnailSourceUpload)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = c.addColumnIfMissing("videos", "preview_track_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "preview_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "source_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "thumbnails", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "thumbnail_sources", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "thumbnail_blurhash", "TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("videos", "thumbnail_version", "TEXT")
+	if err != nil {
+		return err
+	}
+	for _, column := range videoMetadataColumns {
+		_, err = c.addColumnIfMissing("videos", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	videoAssetTable := `
+	CREATE TABLE IF NOT EXISTS video_assets (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		key TEXT NOT NULL,
+		is_prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoAssetTable)
+	if err != nil {
+		return err
+	}
+
+	pendingDeletionTable := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		key TEXT NOT NULL,
+		is_prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(pendingDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	tusUploadTable := `
+	CREATE TABLE IF NOT EXISTS tus_uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		upload_length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		metadata TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(tusUploadTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+	_, err = c.addColumnIfMissing("jobs", "run_after", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// addColumnIfMissing brings tables created by older versions of the app up to
+// date, since CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+// It reports whether the column had to be added.
+func (c *Client) addColumnIfMissing(table, column, definition string) (bool, error) {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
@@ -82,6 +257,18 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM video_assets"); err != nil {
+		return fmt.Errorf("failed to reset table video_assets: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM pending_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table pending_deletions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM tus_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table tus_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
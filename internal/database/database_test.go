@@ -0,0 +1,31 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	client, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { client.db.Close() })
+	return client
+}
+
+func createTestVideo(t *testing.T, client Client) Video {
+	t.Helper()
+	user, err := client.CreateUser(CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	video, err := client.CreateVideo(CreateVideoParams{Title: "Test", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo() error = %v", err)
+	}
+	return video
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+type Job struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError *string    `json:"last_error"`
+	RunAfter  *time.Time `json:"run_after"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Kind    string    `json:"kind"`
+	Payload string    `json:"-"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		kind,
+		payload,
+		status,
+		attempts,
+		last_error,
+		run_after`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.UserID,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.LastError,
+		&job.RunAfter,
+	)
+	return job, err
+}
+
+func queryJobs(tx *sql.Tx, query string, args ...any) ([]Job, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		kind,
+		payload,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.Kind, params.Payload, JobStatusQueued)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return c.GetJob(id)
+}
+
+// ErrJobActive is returned by CreateExclusiveJob when the video already has
+// a job of the same kind queued or running.
+var ErrJobActive = errors.New("job already queued or running")
+
+// CreateExclusiveJob is CreateJob for work that mustn't be queued twice,
+// such as processing an upload a client may complete more than once. The
+// check and the insert are one statement, so concurrent calls can't both
+// succeed.
+func (c Client) CreateExclusiveJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		kind,
+		payload,
+		status
+	)
+	SELECT ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?
+	WHERE NOT EXISTS (
+		SELECT 1 FROM jobs
+		WHERE video_id = ? AND kind = ? AND status IN (?, ?)
+	)
+	`
+	result, err := c.db.Exec(query,
+		id, params.VideoID, params.UserID, params.Kind, params.Payload, JobStatusQueued,
+		params.VideoID, params.Kind, JobStatusQueued, JobStatusRunning,
+	)
+	if err != nil {
+		return Job{}, err
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return Job{}, err
+	}
+	if created == 0 {
+		return Job{}, ErrJobActive
+	}
+
+	return c.GetJob(id)
+}
+
+// GetActiveJob returns the queued or running job of kind for a video, or
+// nil when there is none.
+func (c Client) GetActiveJob(videoID uuid.UUID, kind string) (*Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE video_id = ? AND kind = ? AND status IN (?, ?)
+	ORDER BY created_at, rowid
+	LIMIT 1
+	`
+
+	job, err := scanJob(c.db.QueryRow(query, videoID, kind, JobStatusQueued, JobStatusRunning))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// ClaimNextJob atomically moves the oldest queued job that is due at now to
+// running and returns it. It returns nil when no job is due.
+func (c Client) ClaimNextJob(now time.Time) (*Job, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = ? AND (run_after IS NULL OR run_after <= ?)
+		ORDER BY created_at, rowid
+		LIMIT 1
+	)
+	RETURNING` + jobColumns
+
+	job, err := scanJob(c.db.QueryRow(query, JobStatusRunning, JobStatusQueued, now.UTC()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (c Client) FinishJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusSucceeded, id)
+	return err
+}
+
+// FailJob records a failed attempt. The job goes back to the queue, to run
+// no earlier than retryAt, when retryAt is set and is marked failed
+// otherwise.
+func (c Client) FailJob(id uuid.UUID, reason string, retryAt *time.Time) error {
+	status := JobStatusFailed
+	if retryAt != nil {
+		status = JobStatusQueued
+		utc := retryAt.UTC()
+		retryAt = &utc
+	}
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		run_after = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, reason, retryAt, id)
+	return err
+}
+
+// RequeueRunningJobs puts jobs that were running when the server stopped
+// back in the queue. It must only be called before workers start.
+func (c Client) RequeueRunningJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	result, err := c.db.Exec(query, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
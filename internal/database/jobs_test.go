@@ -0,0 +1,75 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobRetry(t *testing.T) {
+	client := newTestClient(t)
+	video := createTestVideo(t, client)
+	job, err := client.CreateJob(CreateJobParams{VideoID: video.ID, UserID: video.UserID, Kind: "process_video", Payload: "{}"})
+	if err != nil {
+		t.Fatalf("CreateJob() error = %v", err)
+	}
+
+	now := time.Now()
+	claimed, err := client.ClaimNextJob(now)
+	if err != nil || claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("ClaimNextJob() = %v, %v, want job %s", claimed, err, job.ID)
+	}
+	if claimed.Status != JobStatusRunning || claimed.Attempts != 1 {
+		t.Errorf("claimed job has status %s and %d attempts, want running and 1", claimed.Status, claimed.Attempts)
+	}
+	if again, err := client.ClaimNextJob(now); err != nil || again != nil {
+		t.Fatalf("ClaimNextJob() while running = %v, %v, want nil", again, err)
+	}
+
+	retryAt := now.Add(time.Minute)
+	if err := client.FailJob(job.ID, "boom", &retryAt); err != nil {
+		t.Fatalf("FailJob() error = %v", err)
+	}
+	if early, err := client.ClaimNextJob(now.Add(59 * time.Second)); err != nil || early != nil {
+		t.Fatalf("ClaimNextJob() before run_after = %v, %v, want nil", early, err)
+	}
+	retried, err := client.ClaimNextJob(now.Add(time.Minute))
+	if err != nil || retried == nil || retried.ID != job.ID {
+		t.Fatalf("ClaimNextJob() at run_after = %v, %v, want job %s", retried, err, job.ID)
+	}
+	if retried.Attempts != 2 || retried.LastError == nil || *retried.LastError != "boom" {
+		t.Errorf("retried job has %d attempts and error %v, want 2 and boom", retried.Attempts, retried.LastError)
+	}
+
+	if err := client.FailJob(job.ID, "boom again", nil); err != nil {
+		t.Fatalf("FailJob() error = %v", err)
+	}
+	failed, err := client.GetJob(job.ID)
+	if err != nil || failed.Status != JobStatusFailed {
+		t.Fatalf("GetJob() = %+v, %v, want a failed job", failed, err)
+	}
+	if next, err := client.ClaimNextJob(now.Add(time.Hour)); err != nil || next != nil {
+		t.Fatalf("ClaimNextJob() after final failure = %v, %v, want nil", next, err)
+	}
+}
+
+func TestCreateExclusiveJob(t *testing.T) {
+	client := newTestClient(t)
+	video := createTestVideo(t, client)
+	params := CreateJobParams{VideoID: video.ID, UserID: video.UserID, Kind: "process_video", Payload: "{}"}
+
+	first, err := client.CreateExclusiveJob(params)
+	if err != nil {
+		t.Fatalf("CreateExclusiveJob() error = %v", err)
+	}
+	if _, err := client.CreateExclusiveJob(params); !errors.Is(err, ErrJobActive) {
+		t.Fatalf("second CreateExclusiveJob() error = %v, want ErrJobActive", err)
+	}
+
+	if err := client.FinishJob(first.ID); err != nil {
+		t.Fatalf("FinishJob() error = %v", err)
+	}
+	if _, err := client.CreateExclusiveJob(params); err != nil {
+		t.Fatalf("CreateExclusiveJob() after the first finished error = %v", err)
+	}
+}
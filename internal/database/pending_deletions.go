@@ -0,0 +1,260 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PendingDeletion is an outbox entry for an object that must be removed
+// from storage. Entries are only deleted once the object is gone.
+type PendingDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Key           string    `json:"key"`
+	IsPrefix      bool      `json:"is_prefix"`
+	Attempts      int       `json:"attempts"`
+	LastError     *string   `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// DeletedVideo is what deleting a video leaves to clean up outside the
+// database.
+type DeletedVideo struct {
+	// Pending are the queued deletions, for the caller to try right away.
+	Pending []PendingDeletion
+	// Jobs are the video's deleted jobs. Their spooled uploads are still on
+	// disk, and running ones have yet to be stopped.
+	Jobs []Job
+	// TusUploads are the video's unfinished resumable uploads, whose
+	// partial files are still on disk.
+	TusUploads []uuid.UUID
+}
+
+// DeleteVideoAndQueueObjects deletes a video with its asset records, jobs
+// and resumable uploads and, in the same transaction, queues every asset,
+// extraKeys and the objects jobObjects names for each job for deletion from
+// storage.
+func (c Client) DeleteVideoAndQueueObjects(id uuid.UUID, extraKeys []string, jobObjects func(Job) []string) (DeletedVideo, error) {
+	deleted := DeletedVideo{}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return deleted, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	SELECT key, is_prefix
+	FROM video_assets
+	WHERE video_id = ?
+	`, id)
+	if err != nil {
+		return deleted, err
+	}
+	objects := map[string]bool{}
+	for rows.Next() {
+		var key string
+		var isPrefix bool
+		if err := rows.Scan(&key, &isPrefix); err != nil {
+			rows.Close()
+			return deleted, err
+		}
+		objects[key] = objects[key] || isPrefix
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return deleted, err
+	}
+
+	deleted.Jobs, err = queryJobs(tx, "SELECT"+jobColumns+" FROM jobs WHERE video_id = ?", id)
+	if err != nil {
+		return deleted, err
+	}
+	for _, job := range deleted.Jobs {
+		extraKeys = append(extraKeys, jobObjects(job)...)
+	}
+	for _, key := range extraKeys {
+		if _, ok := objects[key]; !ok {
+			objects[key] = false
+		}
+	}
+
+	deleted.TusUploads, err = queryIDs(tx, "SELECT id FROM tus_uploads WHERE video_id = ?", id)
+	if err != nil {
+		return deleted, err
+	}
+
+	now := time.Now().UTC()
+	for key, isPrefix := range objects {
+		entry, err := queuePendingDeletion(tx, key, isPrefix, now)
+		if err != nil {
+			return deleted, err
+		}
+		deleted.Pending = append(deleted.Pending, entry)
+	}
+
+	for _, table := range []string{"video_assets", "jobs", "tus_uploads"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE video_id = ?", id); err != nil {
+			return deleted, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM videos WHERE id = ?", id); err != nil {
+		return deleted, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+func queryIDs(tx *sql.Tx, query string, args ...any) ([]uuid.UUID, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func queuePendingDeletion(tx *sql.Tx, key string, isPrefix bool, now time.Time) (PendingDeletion, error) {
+	entry := PendingDeletion{
+		ID:            uuid.New(),
+		CreatedAt:     now,
+		Key:           key,
+		IsPrefix:      isPrefix,
+		NextAttemptAt: now,
+	}
+	query := `
+	INSERT INTO pending_deletions (
+		id,
+		created_at,
+		key,
+		is_prefix,
+		attempts,
+		next_attempt_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, 0, ?)
+	`
+	_, err := tx.Exec(query, entry.ID, entry.Key, entry.IsPrefix, entry.NextAttemptAt)
+	if err != nil {
+		return PendingDeletion{}, err
+	}
+	return entry, nil
+}
+
+func (c Client) GetDuePendingDeletions(now time.Time, limit int) ([]PendingDeletion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		key,
+		is_prefix,
+		attempts,
+		last_error,
+		next_attempt_at
+	FROM pending_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []PendingDeletion{}
+	for rows.Next() {
+		var entry PendingDeletion
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.Key,
+			&entry.IsPrefix,
+			&entry.Attempts,
+			&entry.LastError,
+			&entry.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		pending = append(pending, entry)
+	}
+
+	return pending, rows.Err()
+}
+
+func (c Client) GetPendingDeletionKeys() ([]string, error) {
+	rows, err := c.db.Query("SELECT key FROM pending_deletions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (c Client) MarkPendingDeletionFailed(id uuid.UUID, reason string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE pending_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, reason, nextAttemptAt.UTC(), id)
+	return err
+}
+
+func (c Client) DeletePendingDeletion(id uuid.UUID) error {
+	query := `
+	DELETE FROM pending_deletions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// CancelPendingDeletion takes key out of the deletion outbox because it is
+// about to be stored again.
+func (c Client) CancelPendingDeletion(key string) error {
+	query := `
+	DELETE FROM pending_deletions
+	WHERE key = ?
+	`
+	_, err := c.db.Exec(query, key)
+	return err
+}
+
+// PendingDeletionIsDue reports whether an outbox entry is still queued and
+// its key isn't tracked as a video asset again.
+func (c Client) PendingDeletionIsDue(id uuid.UUID, key string) (bool, error) {
+	query := `
+	SELECT
+		EXISTS (SELECT 1 FROM pending_deletions WHERE id = ?)
+		AND NOT EXISTS (SELECT 1 FROM video_assets WHERE key = ?)
+	`
+	var due bool
+	err := c.db.QueryRow(query, id, key).Scan(&due)
+	return due, err
+}
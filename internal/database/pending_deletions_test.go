@@ -0,0 +1,109 @@
+package database
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDeleteVideoAndQueueObjects(t *testing.T) {
+	client := newTestClient(t)
+	video := createTestVideo(t, client)
+	other := createTestVideo(t, client)
+
+	assets := []CreateVideoAssetParams{
+		{VideoID: video.ID, Kind: "video", Key: "landscape/a.mp4"},
+		{VideoID: video.ID, Kind: "hls", Key: "hls/a/", IsPrefix: true},
+		{VideoID: other.ID, Kind: "video", Key: "landscape/other.mp4"},
+	}
+	for _, params := range assets {
+		if _, err := client.CreateVideoAsset(params); err != nil {
+			t.Fatalf("CreateVideoAsset() error = %v", err)
+		}
+	}
+	staged, err := client.CreateJob(CreateJobParams{VideoID: video.ID, UserID: video.UserID, Kind: "process_video", Payload: "staged"})
+	if err != nil {
+		t.Fatalf("CreateJob() error = %v", err)
+	}
+	spooled, err := client.CreateJob(CreateJobParams{VideoID: video.ID, UserID: video.UserID, Kind: "process_video", Payload: "spooled"})
+	if err != nil {
+		t.Fatalf("CreateJob() error = %v", err)
+	}
+	otherJob, err := client.CreateJob(CreateJobParams{VideoID: other.ID, UserID: other.UserID, Kind: "process_video", Payload: "staged"})
+	if err != nil {
+		t.Fatalf("CreateJob() error = %v", err)
+	}
+	upload, err := client.CreateTusUpload(CreateTusUploadParams{VideoID: video.ID, UserID: video.UserID, UploadLength: 10})
+	if err != nil {
+		t.Fatalf("CreateTusUpload() error = %v", err)
+	}
+
+	jobObjects := func(job Job) []string {
+		if job.Payload == "staged" {
+			return []string{"uploads/" + job.ID.String()}
+		}
+		return nil
+	}
+	deleted, err := client.DeleteVideoAndQueueObjects(video.ID, []string{"legacy.png", "landscape/a.mp4"}, jobObjects)
+	if err != nil {
+		t.Fatalf("DeleteVideoAndQueueObjects() error = %v", err)
+	}
+
+	gotPending := map[string]bool{}
+	for _, entry := range deleted.Pending {
+		gotPending[entry.Key] = entry.IsPrefix
+	}
+	wantPending := map[string]bool{
+		"landscape/a.mp4":               false,
+		"hls/a/":                        true,
+		"legacy.png":                    false,
+		"uploads/" + staged.ID.String(): false,
+	}
+	if len(gotPending) != len(wantPending) || len(deleted.Pending) != len(wantPending) {
+		t.Errorf("queued %v, want %v", gotPending, wantPending)
+	}
+	for key, isPrefix := range wantPending {
+		if got, ok := gotPending[key]; !ok || got != isPrefix {
+			t.Errorf("queued %s = %v, %v, want prefix %v", key, got, ok, isPrefix)
+		}
+	}
+
+	gotJobs := []string{}
+	for _, job := range deleted.Jobs {
+		gotJobs = append(gotJobs, job.ID.String())
+	}
+	wantJobs := []string{staged.ID.String(), spooled.ID.String()}
+	sort.Strings(gotJobs)
+	sort.Strings(wantJobs)
+	if len(gotJobs) != 2 || gotJobs[0] != wantJobs[0] || gotJobs[1] != wantJobs[1] {
+		t.Errorf("deleted jobs %v, want %v", gotJobs, wantJobs)
+	}
+	if len(deleted.TusUploads) != 1 || deleted.TusUploads[0] != upload.ID {
+		t.Errorf("deleted uploads %v, want [%s]", deleted.TusUploads, upload.ID)
+	}
+
+	if got, err := client.GetVideo(video.ID); err == nil && got.ID == video.ID {
+		t.Error("video still exists")
+	}
+	if job, err := client.GetJob(staged.ID); err != nil || job.ID == staged.ID {
+		t.Errorf("GetJob() = %+v, %v, want the job gone", job, err)
+	}
+	if got, err := client.GetTusUpload(upload.ID); err == nil && got.ID == upload.ID {
+		t.Error("upload still exists")
+	}
+	if remaining, err := client.GetVideoAssets(video.ID); err != nil || len(remaining) != 0 {
+		t.Errorf("GetVideoAssets() = %v, %v, want none", remaining, err)
+	}
+
+	// Nothing of the other video is touched.
+	if job, err := client.GetJob(otherJob.ID); err != nil || job.ID != otherJob.ID {
+		t.Errorf("GetJob() of the other video = %+v, %v", job, err)
+	}
+	if remaining, err := client.GetVideoAssets(other.ID); err != nil || len(remaining) != 1 {
+		t.Errorf("GetVideoAssets() of the other video = %v, %v, want one", remaining, err)
+	}
+	due, err := client.GetDuePendingDeletions(time.Now().Add(time.Minute), 100)
+	if err != nil || len(due) != len(wantPending) {
+		t.Errorf("GetDuePendingDeletions() = %d entries, %v, want %d", len(due), err, len(wantPending))
+	}
+}
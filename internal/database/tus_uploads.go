@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TusUpload tracks a resumable upload. The bytes live in a file named after
+// the upload ID; UploadOffset is how many of them have been committed.
+type TusUpload struct {
+	ID           uuid.UUID `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	UploadOffset int64     `json:"upload_offset"`
+	CreateTusUploadParams
+}
+
+type CreateTusUploadParams struct {
+	VideoID      uuid.UUID `json:"video_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	UploadLength int64     `json:"upload_length"`
+	Metadata     string    `json:"metadata"`
+}
+
+func (c Client) CreateTusUpload(params CreateTusUploadParams) (TusUpload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO tus_uploads (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.UploadLength, params.Metadata)
+	if err != nil {
+		return TusUpload{}, err
+	}
+
+	return c.GetTusUpload(id)
+}
+
+func (c Client) GetTusUpload(id uuid.UUID) (TusUpload, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		metadata
+	FROM tus_uploads
+	WHERE id = ?
+	`
+
+	var upload TusUpload
+	err := c.db.QueryRow(query, id).Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.UploadLength,
+		&upload.UploadOffset,
+		&upload.Metadata,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TusUpload{}, nil
+		}
+		return TusUpload{}, err
+	}
+
+	return upload, nil
+}
+
+func (c Client) UpdateTusUploadOffset(id uuid.UUID, offset int64) error {
+	query := `
+	UPDATE tus_uploads
+	SET
+		upload_offset = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, id)
+	return err
+}
+
+func (c Client) DeleteTusUpload(id uuid.UUID) error {
+	query := `
+	DELETE FROM tus_uploads
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// GetStaleTusUploads returns uploads that haven't received data since before.
+func (c Client) GetStaleTusUploads(before time.Time) ([]uuid.UUID, error) {
+	rows, err := c.db.Query("SELECT id FROM tus_uploads WHERE updated_at < ?", before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
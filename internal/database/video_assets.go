@@ -0,0 +1,217 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoAsset records an object in storage that belongs to a video. When
+// IsPrefix is set, Key is a prefix and every object below it belongs to the
+// video.
+type VideoAsset struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateVideoAssetParams
+}
+
+type CreateVideoAssetParams struct {
+	VideoID  uuid.UUID `json:"video_id"`
+	Kind     string    `json:"kind"`
+	Key      string    `json:"key"`
+	IsPrefix bool      `json:"is_prefix"`
+}
+
+// ErrVideoDeleted is returned by CreateVideoAsset when the video was deleted
+// while its asset was being made.
+var ErrVideoDeleted = errors.New("video no longer exists")
+
+// CreateVideoAsset tracks an object of a video. The row is only added while
+// the video exists, so an object stored by a job that outlived its video
+// stays unreferenced and is left to gc.
+func (c Client) CreateVideoAsset(params CreateVideoAssetParams) (VideoAsset, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO video_assets (
+		id,
+		created_at,
+		video_id,
+		kind,
+		key,
+		is_prefix
+	)
+	SELECT ?, CURRENT_TIMESTAMP, ?, ?, ?, ?
+	WHERE EXISTS (SELECT 1 FROM videos WHERE id = ?)
+	`
+	result, err := c.db.Exec(query, id, params.VideoID, params.Kind, params.Key, params.IsPrefix, params.VideoID)
+	if err != nil {
+		return VideoAsset{}, err
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return VideoAsset{}, err
+	}
+	if created == 0 {
+		return VideoAsset{}, ErrVideoDeleted
+	}
+	// A content-addressed key may have been retired earlier and still be
+	// waiting in the deletion outbox; it is in use again now.
+	if err := c.CancelPendingDeletion(params.Key); err != nil {
+		return VideoAsset{}, err
+	}
+
+	return VideoAsset{
+		ID:                     id,
+		CreatedAt:              time.Now().UTC(),
+		CreateVideoAssetParams: params,
+	}, nil
+}
+
+func (c Client) GetAllVideoAssets() ([]VideoAsset, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		kind,
+		key,
+		is_prefix
+	FROM video_assets
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []VideoAsset{}
+	for rows.Next() {
+		var asset VideoAsset
+		if err := rows.Scan(
+			&asset.ID,
+			&asset.CreatedAt,
+			&asset.VideoID,
+			&asset.Kind,
+			&asset.Key,
+			&asset.IsPrefix,
+		); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+func (c Client) GetVideoAssets(videoID uuid.UUID) ([]VideoAsset, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		kind,
+		key,
+		is_prefix
+	FROM video_assets
+	WHERE video_id = ?
+	ORDER BY created_at DESC, rowid DESC
+	`
+
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []VideoAsset{}
+	for rows.Next() {
+		var asset VideoAsset
+		if err := rows.Scan(
+			&asset.ID,
+			&asset.CreatedAt,
+			&asset.VideoID,
+			&asset.Kind,
+			&asset.Key,
+			&asset.IsPrefix,
+		); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+// RetireVideoAssets keeps the newest asset of the given kind plus keep
+// previous versions; a negative keep retires them all. Older versions are
+// removed from video_assets and queued for deletion from storage in the
+// same transaction.
+func (c Client) RetireVideoAssets(videoID uuid.UUID, kind string, keep int) ([]PendingDeletion, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT id, key, is_prefix
+	FROM video_assets
+	WHERE video_id = ? AND kind = ?
+	ORDER BY created_at DESC, rowid DESC
+	`
+	rows, err := tx.Query(query, videoID, kind)
+	if err != nil {
+		return nil, err
+	}
+	type retired struct {
+		id       uuid.UUID
+		key      string
+		isPrefix bool
+	}
+	old := []retired{}
+	keptKeys := map[string]bool{}
+	for rows.Next() {
+		var asset retired
+		if err := rows.Scan(&asset.id, &asset.key, &asset.isPrefix); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(keptKeys) < keep+1 && !keptKeys[asset.key] {
+			keptKeys[asset.key] = true
+			continue
+		}
+		old = append(old, asset)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	pending := []PendingDeletion{}
+	for _, asset := range old {
+		// Content-addressed assets can be stored again under the same key;
+		// the object is still in use then and only the old row goes away.
+		if keptKeys[asset.key] {
+			if _, err := tx.Exec("DELETE FROM video_assets WHERE id = ?", asset.id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entry, err := queuePendingDeletion(tx, asset.key, asset.isPrefix, now)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, entry)
+		if _, err := tx.Exec("DELETE FROM video_assets WHERE id = ?", asset.id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
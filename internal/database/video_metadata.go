@@ -0,0 +1,135 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// VideoMetadata describes the uploaded file as reported by ffprobe.
+type VideoMetadata struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	VideoCodec      string  `json:"video_codec"`
+	AudioCodec      string  `json:"audio_codec"`
+	BitRate         int64   `json:"bit_rate"`
+	FrameRate       float64 `json:"frame_rate"`
+	AudioChannels   int     `json:"audio_channels"`
+	Container       string  `json:"container"`
+	FileSize        int64   `json:"file_size"`
+}
+
+// videoMetadataColumns are added to videos by migrate. A video that hasn't
+// been processed yet has an empty video_codec.
+var videoMetadataColumns = []struct {
+	name       string
+	definition string
+}{
+	{"duration_seconds", "REAL NOT NULL DEFAULT 0"},
+	{"width", "INTEGER NOT NULL DEFAULT 0"},
+	{"height", "INTEGER NOT NULL DEFAULT 0"},
+	{"video_codec", "TEXT NOT NULL DEFAULT ''"},
+	{"audio_codec", "TEXT NOT NULL DEFAULT ''"},
+	{"bit_rate", "INTEGER NOT NULL DEFAULT 0"},
+	{"frame_rate", "REAL NOT NULL DEFAULT 0"},
+	{"audio_channels", "INTEGER NOT NULL DEFAULT 0"},
+	{"container", "TEXT NOT NULL DEFAULT ''"},
+	{"file_size", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func (c Client) UpdateVideoMetadata(id uuid.UUID, meta VideoMetadata) error {
+	query := `
+	UPDATE videos
+	SET
+		duration_seconds = ?,
+		width = ?,
+		height = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		bit_rate = ?,
+		frame_rate = ?,
+		audio_channels = ?,
+		container = ?,
+		file_size = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(
+		query,
+		meta.DurationSeconds,
+		meta.Width,
+		meta.Height,
+		meta.VideoCodec,
+		meta.AudioCodec,
+		meta.BitRate,
+		meta.FrameRate,
+		meta.AudioChannels,
+		meta.Container,
+		meta.FileSize,
+		id,
+	)
+	return err
+}
+
+// VideoFilter narrows GetVideos down. Zero values don't filter.
+type VideoFilter struct {
+	Status string
+	// The bounds are inclusive and nil when not filtered on, so a bound of
+	// zero still applies.
+	MinDuration *float64
+	MaxDuration *float64
+	MinWidth    *int
+	MaxWidth    *int
+	MinHeight   *int
+	MaxHeight   *int
+	VideoCodec  string
+	AudioCodec  string
+	// Container matches any of ffprobe's format names, e.g. "mp4" matches
+	// "mov,mp4,m4a,3gp,3g2,mj2".
+	Container string
+}
+
+func (f VideoFilter) where() (string, []any) {
+	conditions := []string{}
+	args := []any{}
+	add := func(condition string, arg any) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if f.Status != "" {
+		add("status = ?", f.Status)
+	}
+	if f.MinDuration != nil {
+		add("duration_seconds >= ?", *f.MinDuration)
+	}
+	if f.MaxDuration != nil {
+		add("duration_seconds <= ?", *f.MaxDuration)
+	}
+	if f.MinWidth != nil {
+		add("width >= ?", *f.MinWidth)
+	}
+	if f.MaxWidth != nil {
+		add("width <= ?", *f.MaxWidth)
+	}
+	if f.MinHeight != nil {
+		add("height >= ?", *f.MinHeight)
+	}
+	if f.MaxHeight != nil {
+		add("height <= ?", *f.MaxHeight)
+	}
+	if f.VideoCodec != "" {
+		add("video_codec = ?", f.VideoCodec)
+	}
+	if f.AudioCodec != "" {
+		add("audio_codec = ?", f.AudioCodec)
+	}
+	if f.Container != "" {
+		add("instr(',' || container || ',', ',' || ? || ',') > 0", f.Container)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestVideoFilterWhere(t *testing.T) {
+	zero, ten := 0.0, 10.0
+	zeroInt, hd := 0, 720
+
+	tests := []struct {
+		name           string
+		filter         VideoFilter
+		wantConditions string
+		wantArgs       []any
+	}{
+		{name: "empty"},
+		{
+			name:           "status and codecs",
+			filter:         VideoFilter{Status: "ready", VideoCodec: "h264", AudioCodec: "aac"},
+			wantConditions: " AND status = ? AND video_codec = ? AND audio_codec = ?",
+			wantArgs:       []any{"ready", "h264", "aac"},
+		},
+		{
+			name:           "zero bounds apply",
+			filter:         VideoFilter{MaxDuration: &zero, MaxWidth: &zeroInt},
+			wantConditions: " AND duration_seconds <= ? AND width <= ?",
+			wantArgs:       []any{0.0, 0},
+		},
+		{
+			name:           "all bounds",
+			filter:         VideoFilter{MinDuration: &zero, MaxDuration: &ten, MinWidth: &zeroInt, MaxWidth: &hd, MinHeight: &hd, MaxHeight: &hd},
+			wantConditions: " AND duration_seconds >= ? AND duration_seconds <= ? AND width >= ? AND width <= ? AND height >= ? AND height <= ?",
+			wantArgs:       []any{0.0, 10.0, 0, 720, 720, 720},
+		},
+		{
+			name:           "container",
+			filter:         VideoFilter{Container: "mp4"},
+			wantConditions: " AND instr(',' || container || ',', ',' || ? || ',') > 0",
+			wantArgs:       []any{"mp4"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conditions, args := tc.filter.where()
+			if conditions != tc.wantConditions {
+				t.Errorf("where() conditions = %q, want %q", conditions, tc.wantConditions)
+			}
+			if fmt.Sprint(args) != fmt.Sprint(tc.wantArgs) {
+				t.Errorf("where() args = %v, want %v", args, tc.wantArgs)
+			}
+		})
+	}
+}
+
+func TestGetVideosFilter(t *testing.T) {
+	client := newTestClient(t)
+	unprocessed := createTestVideo(t, client)
+	userID := unprocessed.UserID
+
+	videos := map[string]VideoMetadata{
+		"short": {DurationSeconds: 5, Width: 640, Height: 360, VideoCodec: "h264", Container: "mov,mp4,m4a,3gp,3g2,mj2"},
+		"long":  {DurationSeconds: 600, Width: 1920, Height: 1080, VideoCodec: "vp9", Container: "matroska,webm"},
+	}
+	for title, meta := range videos {
+		video, err := client.CreateVideo(CreateVideoParams{Title: title, UserID: userID})
+		if err != nil {
+			t.Fatalf("CreateVideo() error = %v", err)
+		}
+		if err := client.UpdateVideoMetadata(video.ID, meta); err != nil {
+			t.Fatalf("UpdateVideoMetadata() error = %v", err)
+		}
+	}
+
+	zero, minute := 0.0, 60.0
+	zeroInt, hd := 0, 720
+	tests := []struct {
+		name   string
+		filter VideoFilter
+		want   []string
+	}{
+		{"no filter", VideoFilter{}, []string{"Test", "long", "short"}},
+		{"max duration zero", VideoFilter{MaxDuration: &zero}, []string{"Test"}},
+		{"max width zero", VideoFilter{MaxWidth: &zeroInt}, []string{"Test"}},
+		{"max duration", VideoFilter{MaxDuration: &minute}, []string{"Test", "short"}},
+		{"min height", VideoFilter{MinHeight: &hd}, []string{"long"}},
+		{"container alias", VideoFilter{Container: "mp4"}, []string{"short"}},
+		{"container substring", VideoFilter{Container: "web"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := client.GetVideos(userID, tc.filter)
+			if err != nil {
+				t.Fatalf("GetVideos() error = %v", err)
+			}
+			titles := []string{}
+			for _, video := range got {
+				titles = append(titles, video.Title)
+			}
+			sort.Strings(titles)
+			if fmt.Sprint(titles) != fmt.Sprint(tc.want) {
+				t.Errorf("GetVideos() = %v, want %v", titles, tc.want)
+			}
+		})
+	}
+}
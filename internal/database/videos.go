@@ -2,18 +2,59 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Where a video's thumbnail came from. Only automatic thumbnails are
+// replaced by processing.
+const (
+	ThumbnailSourceUpload = "upload"
+	ThumbnailSourceAuto   = "auto"
+	ThumbnailSourceFrame  = "frame"
+)
+
+const (
+	VideoStatusDraft      = "draft"
+	VideoStatusUploading  = "uploading"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID              uuid.UUID `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	ThumbnailURL    *string   `json:"thumbnail_url"`
+	ThumbnailSource *string   `json:"thumbnail_source"`
+	VideoURL        *string   `json:"video_url"`
+	DashURL         *string   `json:"dash_url"`
+	PreviewTrackURL *string   `json:"preview_track_url"`
+	PreviewURL      *string   `json:"preview_url"`
+	SourceURL       *string   `json:"source_url"`
+	Status          string    `json:"status"`
+	FailureReason   *string   `json:"failure_reason"`
+	// Metadata is nil until the uploaded file has been probed.
+	Metadata *VideoMetadata `json:"metadata"`
+	// Thumbnails maps each rendition width in pixels to the URL of its JPEG
+	// or PNG version.
+	Thumbnails      map[int]string `json:"thumbnails"`
+	ThumbnailSrcset *string        `json:"thumbnail_srcset"`
+	// ThumbnailSources are the same renditions in formats that not every
+	// browser supports, most preferred first, for <picture> elements.
+	ThumbnailSources []ThumbnailSource `json:"thumbnail_sources"`
+	// ThumbnailBlurhash is a BlurHash of the thumbnail to show while it loads.
+	ThumbnailBlurhash *string `json:"thumbnail_blurhash"`
+	// ThumbnailVersion changes whenever the thumbnail does. It is nil for
+	// thumbnails stored before versions were tracked.
+	ThumbnailVersion *string `json:"thumbnail_version"`
 	CreateVideoParams
 }
 
@@ -21,11 +62,12 @@ type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
+	// KeepVersions is how many previous thumbnails and video files are kept
+	// in storage after a re-upload. Zero keeps only the current one.
+	KeepVersions int `json:"keep_versions"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +75,100 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		keep_versions,
+		status,
+		failure_reason,
+		dash_url,
+		duration_seconds,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		bit_rate,
+		frame_rate,
+		audio_channels,
+		container,
+		file_size,
+		thumbnail_source,
+		preview_track_url,
+		preview_url,
+		source_url,
+		thumbnails,
+		thumbnail_sources,
+		thumbnail_blurhash,
+		thumbnail_version`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var meta VideoMetadata
+	var thumbnails, thumbnailSources sql.NullString
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.KeepVersions,
+		&video.Status,
+		&video.FailureReason,
+		&video.DashURL,
+		&meta.DurationSeconds,
+		&meta.Width,
+		&meta.Height,
+		&meta.VideoCodec,
+		&meta.AudioCodec,
+		&meta.BitRate,
+		&meta.FrameRate,
+		&meta.AudioChannels,
+		&meta.Container,
+		&meta.FileSize,
+		&video.ThumbnailSource,
+		&video.PreviewTrackURL,
+		&video.PreviewURL,
+		&video.SourceURL,
+		&thumbnails,
+		&thumbnailSources,
+		&video.ThumbnailBlurhash,
+		&video.ThumbnailVersion,
+	)
+	if err != nil {
+		return video, err
+	}
+	if meta.VideoCodec != "" {
+		video.Metadata = &meta
+	}
+	if thumbnails.Valid {
+		if err := json.Unmarshal([]byte(thumbnails.String), &video.Thumbnails); err != nil {
+			return video, err
+		}
+		video.ThumbnailSrcset = ThumbnailSrcset(video.Thumbnails)
+	}
+	if thumbnailSources.Valid {
+		if err := json.Unmarshal([]byte(thumbnailSources.String), &video.ThumbnailSources); err != nil {
+			return video, err
+		}
+	}
+	return video, nil
+}
+
+func (c Client) GetVideos(userID uuid.UUID, filter VideoFilter) ([]Video, error) {
+	conditions, args := filter.where()
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
+	WHERE user_id = ?` + conditions + `
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, append([]any{userID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +176,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,6 +186,30 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
 	query := `
@@ -75,10 +219,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		keep_versions,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID, params.KeepVersions, VideoStatusDraft)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +234,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -129,7 +258,9 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		dash_url = ?,
+		user_id = ?,
+		keep_versions = ?
 	WHERE id = ?
 	`
 
@@ -139,12 +270,168 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
+		&video.DashURL,
 		video.UserID,
+		video.KeepVersions,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoOutputs stores the URLs produced by processing without
+// touching fields the owner may have changed while it ran.
+func (c Client) UpdateVideoOutputs(video Video) error {
+	query := `
+	UPDATE videos
+	SET
+		video_url = ?,
+		dash_url = ?,
+		preview_track_url = ?,
+		preview_url = ?,
+		source_url = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(
+		query,
+		video.VideoURL,
+		video.DashURL,
+		video.PreviewTrackURL,
+		video.PreviewURL,
+		video.SourceURL,
+		video.ID,
+	)
+	return err
+}
+
+// ThumbnailSource is a thumbnail's renditions in one image format.
+type ThumbnailSource struct {
+	Type   string         `json:"type"`
+	Sizes  map[int]string `json:"sizes"`
+	Srcset string         `json:"srcset"`
+}
+
+type SetVideoThumbnailParams struct {
+	URL    string
+	Source string
+	// Sizes are the renditions in the fallback format by width.
+	Sizes    map[int]string
+	Sources  []ThumbnailSource
+	Blurhash *string
+	Version  string
+}
+
+// SetVideoThumbnail points the video at a new thumbnail and its renditions.
+// With keepChosen, a thumbnail that didn't come from ThumbnailSourceAuto is
+// left in place; the result reports whether the video was changed.
+func (c Client) SetVideoThumbnail(id uuid.UUID, params SetVideoThumbnailParams, keepChosen bool) (bool, error) {
+	thumbnails, err := marshalNullable(params.Sizes, len(params.Sizes) > 0)
+	if err != nil {
+		return false, err
+	}
+	sources, err := marshalNullable(params.Sources, len(params.Sources) > 0)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnail_source = ?,
+		thumbnails = ?,
+		thumbnail_sources = ?,
+		thumbnail_blurhash = ?,
+		thumbnail_version = ?
+	WHERE id = ?
+	`
+	if keepChosen {
+		query += `AND (thumbnail_url IS NULL OR thumbnail_source = '` + ThumbnailSourceAuto + `')`
+	}
+	result, err := c.db.Exec(query, params.URL, params.Source, thumbnails, sources, params.Blurhash, params.Version, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// marshalNullable encodes v as JSON for a TEXT column, or NULL when present
+// is false.
+func marshalNullable(v any, present bool) (*string, error) {
+	if !present {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	encoded := string(data)
+	return &encoded, nil
+}
+
+// ThumbnailSrcset formats thumbnail renditions as an HTML srcset value,
+// e.g. "https://.../320.jpg 320w, https://.../640.jpg 640w".
+func ThumbnailSrcset(sizes map[int]string) *string {
+	if len(sizes) == 0 {
+		return nil
+	}
+	widths := make([]int, 0, len(sizes))
+	for width := range sizes {
+		widths = append(widths, width)
+	}
+	sort.Ints(widths)
+	candidates := make([]string, 0, len(widths))
+	for _, width := range widths {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", sizes[width], width))
+	}
+	srcset := strings.Join(candidates, ", ")
+	return &srcset
+}
+
+// UpdateVideoStatus moves a video through its processing lifecycle. It is
+// kept apart from UpdateVideo so concurrent metadata edits can't roll the
+// status back. reason is only kept for failed videos.
+func (c Client) UpdateVideoStatus(id uuid.UUID, status string, reason *string) error {
+	query := `
+	UPDATE videos
+	SET
+		status = ?,
+		failure_reason = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, reason, id)
+	return err
+}
+
+// GetStaleUploadingVideos returns videos that have been uploading since
+// before without a resumable upload in progress, such as direct uploads
+// that were presigned but never completed.
+func (c Client) GetStaleUploadingVideos(before time.Time) ([]uuid.UUID, error) {
+	query := `
+	SELECT id FROM videos
+	WHERE status = ?
+		AND updated_at < ?
+		AND NOT EXISTS (SELECT 1 FROM tus_uploads WHERE tus_uploads.video_id = videos.id)
+	`
+	rows, err := c.db.Query(query, VideoStatusUploading, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
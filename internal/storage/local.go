@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps objects as plain files below a root directory. It is
+// used for offline development and for serving assets straight from disk.
+type LocalStore struct {
+	root    string
+	baseURL string
+}
+
+func NewLocalStore(root, baseURL string) *LocalStore {
+	return &LocalStore{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("couldn't create directory for %s: %w", key, err)
+	}
+
+	// Write to a temporary sibling and rename so readers never see a
+	// partially written object.
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create file for %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	total := int64(-1)
+	if _, size, ok := seekableSize(body); ok {
+		total = size
+	}
+	if _, err := io.Copy(&progressWriter{ctx: ctx, w: tmp, total: total}, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write %s: %w", key, err)
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, localError(key, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, localError(key, err)
+	}
+	return f, s.info(key, stat), nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return localError(key, err)
+	}
+	s.pruneEmptyDirs(filepath.Dir(p))
+	return nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, localError(key, err)
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return s.info(key, stat), nil
+}
+
+// Locate returns the path of the file holding key.
+func (s *LocalStore) Locate(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return "", err
+	}
+	return s.path(key)
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, s.info(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list objects under %q: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+func (s *LocalStore) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, key)
+}
+
+// path maps a key to a file below root, refusing keys that would escape it.
+func (s *LocalStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || cleaned[1:] != key {
+		return "", fmt.Errorf("%q: %w", key, ErrInvalidKey)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStore) info(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: stat.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
+
+func (s *LocalStore) pruneEmptyDirs(dir string) {
+	root := filepath.Clean(s.root)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func localError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// ProgressFunc is called as an object is written. total is -1 when the size
+// isn't known up front.
+type ProgressFunc func(written, total int64)
+
+type progressKey struct{}
+
+// WithProgress attaches a ProgressFunc to ctx. Stores report through it while
+// Put is running.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, written, total int64) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		fn(written, total)
+	}
+}
+
+// progressWriter reports the running byte count of everything written to it.
+type progressWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	written int64
+	total   int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	reportProgress(p.ctx, p.written, p.total)
+	return n, err
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3Store struct {
+	client    *s3.Client
+	presigner *s3.PresignClient
+	bucket    string
+	baseURL   string
+	multipart MultipartConfig
+}
+
+// NewS3Store returns a BlobStore backed by an S3 bucket. baseURL is the
+// public origin objects are served from, usually a CloudFront distribution.
+func NewS3Store(client *s3.Client, bucket, baseURL string, multipart MultipartConfig) *S3Store {
+	multipart.PartSize = max(multipart.PartSize, minPartSize)
+	return &S3Store{
+		client:    client,
+		presigner: s3.NewPresignClient(client),
+		bucket:    bucket,
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		multipart: multipart,
+	}
+}
+
+// Put stores body under key. Bodies larger than the configured part size
+// are sent as a multipart upload.
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	if _, size, ok := seekableSize(body); ok {
+		if size > s.multipart.PartSize {
+			return s.putMultipart(ctx, key, body, contentType, size)
+		}
+		return s.putObject(ctx, key, body, contentType, size)
+	}
+
+	// Streams of unknown length: buffer up to one part to find out whether
+	// a single request is enough. The buffer grows with the body, so small
+	// objects such as thumbnails don't allocate a whole part.
+	var head bytes.Buffer
+	n, err := head.ReadFrom(io.LimitReader(body, s.multipart.PartSize+1))
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", key, err)
+	}
+	if n <= s.multipart.PartSize {
+		return s.putObject(ctx, key, bytes.NewReader(head.Bytes()), contentType, n)
+	}
+	return s.putMultipart(ctx, key, io.MultiReader(&head, body), contentType, -1)
+}
+
+func (s *S3Store) putObject(ctx context.Context, key string, body io.Reader, contentType string, size int64) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't put object %s: %w", key, err)
+	}
+	reportProgress(ctx, size, size)
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(key, err)
+	}
+	info := ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+		ETag:         strings.Trim(aws.ToString(out.ETag), `"`),
+	}
+	return out.Body, info, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s3Error(key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(key, err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+		ETag:         strings.Trim(aws.ToString(out.ETag), `"`),
+	}, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list objects under %q: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         strings.Trim(aws.ToString(obj.ETag), `"`),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *S3Store) URL(key string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, key)
+}
+
+func s3Error(key string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return fmt.Errorf("s3 request for %s failed: %w", key, err)
+}
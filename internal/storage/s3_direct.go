@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func (s *S3Store) PresignPut(ctx context.Context, key, contentType string, size int64, expires time.Duration) (PresignedRequest, error) {
+	req, err := s.presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return PresignedRequest{}, fmt.Errorf("couldn't presign upload of %s: %w", key, err)
+	}
+	return presignedRequest(req, expires), nil
+}
+
+// Locate presigns a GET request for key. The object is checked first, since
+// a presigned URL for a missing key only fails once it is used.
+func (s *S3Store) Locate(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return "", err
+	}
+	req, err := s.presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("couldn't presign download of %s: %w", key, err)
+	}
+	return req.URL, nil
+}
+
+func (s *S3Store) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't start multipart upload of %s: %w", key, err)
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3Store) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, size int64, expires time.Duration) (PresignedRequest, error) {
+	req, err := s.presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(partNumber),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return PresignedRequest{}, fmt.Errorf("couldn't presign part %d of %s: %w", partNumber, key, err)
+	}
+	return presignedRequest(req, expires), nil
+}
+
+func (s *S3Store) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	sorted := make([]CompletedPart, len(parts))
+	copy(sorted, parts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PartNumber < sorted[j].PartNumber })
+
+	completed := make([]types.CompletedPart, 0, len(sorted))
+	for _, part := range sorted {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't complete multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't abort multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+func presignedRequest(req *v4.PresignedHTTPRequest, expires time.Duration) PresignedRequest {
+	headers := map[string]string{}
+	for name, values := range req.SignedHeader {
+		if http.CanonicalHeaderKey(name) == "Host" || len(values) == 0 {
+			continue
+		}
+		headers[name] = values[0]
+	}
+	return PresignedRequest{
+		Method:    req.Method,
+		URL:       req.URL,
+		Headers:   headers,
+		ExpiresAt: time.Now().UTC().Add(expires),
+	}
+}
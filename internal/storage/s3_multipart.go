@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	minPartSize       = 5 << 20
+	maxUploadParts    = 10000
+	partRetryBaseWait = 500 * time.Millisecond
+)
+
+// MultipartConfig controls how S3Store.Put splits large objects. Objects no
+// larger than PartSize are sent with a single PutObject.
+type MultipartConfig struct {
+	PartSize    int64
+	Concurrency int
+	MaxRetries  int
+}
+
+func DefaultMultipartConfig() MultipartConfig {
+	return MultipartConfig{
+		PartSize:    16 << 20,
+		Concurrency: 4,
+		MaxRetries:  3,
+	}
+}
+
+type uploadPart struct {
+	number  int32
+	body    io.ReadSeeker
+	size    int64
+	release func()
+}
+
+// putMultipart uploads body in parts. Readers that also implement
+// io.ReaderAt and io.Seeker, like *os.File, are read in place; anything else
+// is buffered one part at a time. On any failure the upload is aborted so S3
+// doesn't keep the parts around.
+func (s *S3Store) putMultipart(ctx context.Context, key string, body io.Reader, contentType string, size int64) error {
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't start multipart upload of %s: %w", key, err)
+	}
+	uploadID := aws.ToString(out.UploadId)
+
+	err = s.uploadParts(ctx, key, uploadID, body, size)
+	if err != nil {
+		_, abortErr := s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
+		if abortErr != nil {
+			return errors.Join(err, fmt.Errorf("couldn't abort multipart upload of %s: %w", key, abortErr))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) uploadParts(ctx context.Context, key, uploadID string, body io.Reader, size int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		completed []types.CompletedPart
+		uploaded  int64
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	parts := make(chan uploadPart)
+	for i := 0; i < max(s.multipart.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				etag, err := s.uploadPartWithRetry(ctx, key, uploadID, part)
+				part.release()
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				completed = append(completed, types.CompletedPart{
+					PartNumber: aws.Int32(part.number),
+					ETag:       etag,
+				})
+				uploaded += part.size
+				reportProgress(ctx, uploaded, size)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	produceErr := s.produceParts(ctx, body, parts)
+	close(parts)
+	wg.Wait()
+	if produceErr != nil && !errors.Is(produceErr, context.Canceled) {
+		return fmt.Errorf("couldn't read %s: %w", key, produceErr)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if produceErr != nil {
+		return produceErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.ToInt32(completed[i].PartNumber) < aws.ToInt32(completed[j].PartNumber)
+	})
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't complete multipart upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// produceParts feeds parts to the workers until body is exhausted.
+func (s *S3Store) produceParts(ctx context.Context, body io.Reader, parts chan<- uploadPart) error {
+	send := func(part uploadPart) error {
+		select {
+		case parts <- part:
+			return nil
+		case <-ctx.Done():
+			part.release()
+			return ctx.Err()
+		}
+	}
+
+	if start, size, ok := seekableSize(body); ok {
+		readerAt := body.(io.ReaderAt)
+		partSize := s.multipart.PartSize
+		for (size+partSize-1)/partSize > maxUploadParts {
+			partSize *= 2
+		}
+		number := int32(1)
+		for offset := int64(0); offset < size; offset += partSize {
+			n := min(partSize, size-offset)
+			part := uploadPart{
+				number:  number,
+				body:    io.NewSectionReader(readerAt, start+offset, n),
+				size:    n,
+				release: func() {},
+			}
+			if err := send(part); err != nil {
+				return err
+			}
+			number++
+		}
+		return nil
+	}
+
+	// Bound memory to one buffer per worker plus the one being filled.
+	buffers := make(chan []byte, max(s.multipart.Concurrency, 1)+1)
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- nil
+	}
+	for number := int32(1); ; number++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if buf == nil {
+			buf = make([]byte, s.multipart.PartSize)
+		}
+
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if number > maxUploadParts {
+				return fmt.Errorf("object needs more than %d parts", maxUploadParts)
+			}
+			b := buf
+			part := uploadPart{
+				number:  number,
+				body:    bytes.NewReader(buf[:n]),
+				size:    int64(n),
+				release: func() { buffers <- b },
+			}
+			if sendErr := send(part); sendErr != nil {
+				return sendErr
+			}
+		} else {
+			buffers <- buf
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *S3Store) uploadPartWithRetry(ctx context.Context, key, uploadID string, part uploadPart) (*string, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.multipart.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(partRetryBaseWait << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if _, err := part.body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+
+		out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      aws.String(uploadID),
+			PartNumber:    aws.Int32(part.number),
+			Body:          part.body,
+			ContentLength: aws.Int64(part.size),
+		})
+		if err == nil {
+			return out.ETag, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("couldn't upload part %d of %s after %d attempts: %w", part.number, key, s.multipart.MaxRetries+1, lastErr)
+}
+
+// seekableSize reports the remaining size of readers that can be read in
+// place, such as files. start is the current read position.
+func seekableSize(body io.Reader) (start, size int64, ok bool) {
+	if _, isReaderAt := body.(io.ReaderAt); !isReaderAt {
+		return 0, 0, false
+	}
+	seeker, isSeeker := body.(io.Seeker)
+	if !isSeeker {
+		return 0, 0, false
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, false
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, false
+	}
+	return start, end - start, true
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+var ErrInvalidKey = errors.New("invalid object key")
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+}
+
+// BlobStore is the object storage used for every uploaded or generated asset.
+// Keys are slash separated and never start with a slash.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	URL(key string) string
+}
+
+// PresignedRequest is an HTTP request a client can send straight to the
+// storage backend. Headers must be sent exactly as given.
+type PresignedRequest struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+type CompletedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// DirectUploader is implemented by stores that let clients upload objects
+// without proxying the bytes through the API server.
+type DirectUploader interface {
+	PresignPut(ctx context.Context, key, contentType string, size int64, expires time.Duration) (PresignedRequest, error)
+	CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error)
+	PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, size int64, expires time.Duration) (PresignedRequest, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+// Locator is implemented by stores that can point ffmpeg straight at an
+// object, so it only reads the byte ranges it needs instead of downloading
+// the whole file first.
+type Locator interface {
+	// Locate returns a local path or a URL that stays valid for expires.
+	Locate(ctx context.Context, key string, expires time.Duration) (string, error)
+}
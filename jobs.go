@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobKindProcessVideo = "process_video"
+	maxJobAttempts      = 3
+	jobPollInterval     = 5 * time.Second
+	jobRetryBaseWait    = 30 * time.Second
+)
+
+// errJobAbandoned marks failures that retrying can't fix.
+var errJobAbandoned = errors.New("job abandoned")
+
+// processVideoPayload names the uploaded file a process_video job works on:
+// either a file in the spool directory or an object staged in storage.
+type processVideoPayload struct {
+	SourcePath string `json:"source_path,omitempty"`
+	SourceKey  string `json:"source_key,omitempty"`
+}
+
+// runningJobs lets deleting a video stop the jobs working on it.
+type runningJobs struct {
+	mu      sync.Mutex
+	cancels map[uuid.UUID]map[uuid.UUID]context.CancelFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{cancels: map[uuid.UUID]map[uuid.UUID]context.CancelFunc{}}
+}
+
+// start returns a context for job that is canceled by cancelVideo, and a
+// function to call once the job is done.
+func (j *runningJobs) start(ctx context.Context, job database.Job) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	j.mu.Lock()
+	if j.cancels[job.VideoID] == nil {
+		j.cancels[job.VideoID] = map[uuid.UUID]context.CancelFunc{}
+	}
+	j.cancels[job.VideoID][job.ID] = cancel
+	j.mu.Unlock()
+
+	return ctx, func() {
+		j.mu.Lock()
+		delete(j.cancels[job.VideoID], job.ID)
+		if len(j.cancels[job.VideoID]) == 0 {
+			delete(j.cancels, job.VideoID)
+		}
+		j.mu.Unlock()
+		cancel()
+	}
+}
+
+func (j *runningJobs) cancelVideo(videoID uuid.UUID) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, cancel := range j.cancels[videoID] {
+		cancel()
+	}
+}
+
+func (cfg *apiConfig) newSpoolFile() (*os.File, error) {
+	return os.CreateTemp(cfg.spoolDir, "upload-*")
+}
+
+func (cfg *apiConfig) enqueueJob(videoID, userID uuid.UUID, kind string, payload any) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateJob(database.CreateJobParams{
+		VideoID: videoID,
+		UserID:  userID,
+		Kind:    kind,
+		Payload: string(data),
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	cfg.wakeJobWorkers()
+	return job, nil
+}
+
+func (cfg *apiConfig) wakeJobWorkers() {
+	select {
+	case cfg.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// queueVideoProcessing hands a finished upload to the workers and marks the
+// video as processing.
+func (cfg *apiConfig) queueVideoProcessing(videoID, userID uuid.UUID, payload processVideoPayload) (database.Job, error) {
+	job, err := cfg.enqueueJob(videoID, userID, jobKindProcessVideo, payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	cfg.setVideoStatus(videoID, database.VideoStatusProcessing, nil)
+	return job, nil
+}
+
+// queueVideoProcessingOnce is queueVideoProcessing for uploads a client can
+// complete more than once. It fails with database.ErrJobActive while the
+// video already has a processing job queued or running.
+func (cfg *apiConfig) queueVideoProcessingOnce(videoID, userID uuid.UUID, payload processVideoPayload) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateExclusiveJob(database.CreateJobParams{
+		VideoID: videoID,
+		UserID:  userID,
+		Kind:    jobKindProcessVideo,
+		Payload: string(data),
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	cfg.wakeJobWorkers()
+	cfg.setVideoStatus(videoID, database.VideoStatusProcessing, nil)
+	return job, nil
+}
+
+// runJobWorkers requeues jobs interrupted by a restart and starts n workers.
+func (cfg *apiConfig) runJobWorkers(ctx context.Context, n int) {
+	requeued, err := cfg.db.RequeueRunningJobs()
+	if err != nil {
+		log.Printf("Couldn't requeue interrupted jobs: %v", err)
+	} else if requeued > 0 {
+		log.Printf("Requeued %d interrupted job(s)", requeued)
+	}
+
+	for i := 0; i < n; i++ {
+		go cfg.runJobWorker(ctx)
+	}
+}
+
+func (cfg *apiConfig) runJobWorker(ctx context.Context) {
+	for {
+		job, err := cfg.db.ClaimNextJob(time.Now())
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if job != nil {
+			cfg.runJob(ctx, *job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) {
+	jobCtx, done := cfg.runningJobs.start(ctx, job)
+	defer done()
+
+	var err error
+	switch job.Kind {
+	case jobKindProcessVideo:
+		err = cfg.processVideoJob(jobCtx, job)
+	default:
+		err = fmt.Errorf("%w: unknown job kind %q", errJobAbandoned, job.Kind)
+	}
+
+	if err == nil {
+		if err := cfg.db.FinishJob(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s finished: %v", job.ID, err)
+		}
+		cfg.cleanupJobSource(ctx, job)
+		return
+	}
+
+	// Deleting the video removed the job along with it, so there is
+	// nothing left to record.
+	if errors.Is(err, database.ErrVideoDeleted) || (jobCtx.Err() != nil && ctx.Err() == nil) {
+		log.Printf("Job %s (%s) stopped, video %s was deleted", job.ID, job.Kind, job.VideoID)
+		cfg.cleanupJobSource(ctx, job)
+		return
+	}
+
+	var retryAt *time.Time
+	if job.Attempts < maxJobAttempts && !errors.Is(err, errJobAbandoned) {
+		next := time.Now().Add(jobRetryBackoff(job.Attempts))
+		retryAt = &next
+	}
+	log.Printf("Job %s (%s) attempt %d failed: %v", job.ID, job.Kind, job.Attempts, err)
+	if markErr := cfg.db.FailJob(job.ID, err.Error(), retryAt); markErr != nil {
+		log.Printf("Couldn't record failure of job %s: %v", job.ID, markErr)
+	}
+	if retryAt == nil {
+		if job.Kind == jobKindProcessVideo {
+			reason := strings.TrimPrefix(err.Error(), errJobAbandoned.Error()+": ")
+			cfg.setVideoStatus(job.VideoID, database.VideoStatusFailed, &reason)
+		}
+		cfg.cleanupJobSource(ctx, job)
+	}
+}
+
+// jobRetryBackoff doubles the wait after each failed attempt, so a failure
+// caused by an outage isn't retried straight into it.
+func jobRetryBackoff(attempts int) time.Duration {
+	return jobRetryBaseWait << max(attempts-1, 0)
+}
+
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return fmt.Errorf("%w: invalid payload: %v", errJobAbandoned, err)
+	}
+
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("%w: video %s no longer exists", errJobAbandoned, job.VideoID)
+	}
+
+	sourcePath := payload.SourcePath
+	if payload.SourceKey != "" {
+		sourcePath, err = cfg.downloadObjectToTemp(ctx, payload.SourceKey)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch uploaded video: %w", err)
+		}
+		defer os.Remove(sourcePath)
+	}
+
+	_, err = cfg.processAndStoreVideo(ctx, video, sourcePath)
+	return err
+}
+
+// cleanupJobSource removes the uploaded file a job consumed once the job
+// won't run again.
+func (cfg *apiConfig) cleanupJobSource(ctx context.Context, job database.Job) {
+	removeJobSpoolFile(job)
+	for _, key := range jobSourceObjects(job) {
+		if err := cfg.store.Delete(ctx, key); err != nil {
+			log.Printf("Couldn't remove job source %s: %v", key, err)
+		}
+	}
+}
+
+func jobSource(job database.Job) (processVideoPayload, bool) {
+	var payload processVideoPayload
+	if job.Kind != jobKindProcessVideo {
+		return payload, false
+	}
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return payload, false
+	}
+	return payload, true
+}
+
+// jobSourceObjects returns the upload a job works on when it is staged in
+// storage rather than spooled to disk.
+func jobSourceObjects(job database.Job) []string {
+	if source, ok := jobSource(job); ok && source.SourceKey != "" {
+		return []string{source.SourceKey}
+	}
+	return nil
+}
+
+func removeJobSpoolFile(job database.Job) {
+	source, ok := jobSource(job)
+	if !ok || source.SourcePath == "" {
+		return
+	}
+	if err := os.Remove(source.SourcePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't remove job source %s: %v", source.SourcePath, err)
+	}
+}
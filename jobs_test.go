@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, jobRetryBaseWait},
+		{1, jobRetryBaseWait},
+		{2, 2 * jobRetryBaseWait},
+		{3, 4 * jobRetryBaseWait},
+	}
+	for _, tc := range tests {
+		if got := jobRetryBackoff(tc.attempts); got != tc.want {
+			t.Errorf("jobRetryBackoff(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -24,16 +29,33 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3client         s3.Client
-}
+	storageBackend   string
+	store            storage.BlobStore
+	tusDir           string
+	tusLocks         *uploadLocks
+	spoolDir         string
+	jobWake          chan struct{}
+	runningJobs      *runningJobs
+	keyLocks         *keyLocks
+	progress         *progressHub
+	eventsTickets    *eventsTickets
+	videoOutput      string
+	hlsKeepMP4       bool
+	renditionLadder  []rendition
+	segmentTime      time.Duration
+	dashEnabled      bool
+	aspectTolerance  float64
+	thumbnailAt      string
+	thumbnailSizes   []int
+	thumbnailCrop    string
+	thumbnailFormats []string
+	previewInterval  time.Duration
 
-type thumbnail struct {
-	data      []byte
-	mediaType string
+	previewClipDuration time.Duration
+	previewClipFormat   string
+	keepSource          bool
 }
 
-// var videoThumbnails = map[uuid.UUID]thumbnail{}
-
 func main() {
 	godotenv.Load(".env")
 
@@ -67,33 +89,131 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	var s3Bucket, s3Region, s3CfDistribution string
+	var store storage.BlobStore
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Couldn't setup AWS configuration: %v", err)
+		}
+
+		multipart := storage.DefaultMultipartConfig()
+		multipart.PartSize = int64(getEnvInt("S3_PART_SIZE_MB", int(multipart.PartSize>>20))) << 20
+		multipart.Concurrency = getEnvInt("S3_UPLOAD_CONCURRENCY", multipart.Concurrency)
+		multipart.MaxRetries = getEnvInt("S3_PART_RETRIES", multipart.MaxRetries)
+
+		store = storage.NewS3Store(s3.NewFromConfig(awsCfg), s3Bucket, "https://"+s3CfDistribution, multipart)
+	case "local":
+		store = storage.NewLocalStore(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, use s3 or local", storageBackend)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	tusDir := os.Getenv("TUS_DIR")
+	if tusDir == "" {
+		tusDir = filepath.Join(os.TempDir(), "tubely-tus")
+	}
+	if err := os.MkdirAll(tusDir, 0755); err != nil {
+		log.Fatalf("Couldn't create TUS_DIR: %v", err)
+	}
+
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = filepath.Join(os.TempDir(), "tubely-spool")
+	}
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		log.Fatalf("Couldn't create SPOOL_DIR: %v", err)
+	}
+
+	videoOutput := os.Getenv("VIDEO_OUTPUT")
+	if videoOutput == "" {
+		videoOutput = videoOutputMP4
+	}
+	if videoOutput != videoOutputMP4 && videoOutput != videoOutputHLS {
+		log.Fatalf("Unknown VIDEO_OUTPUT %q, use mp4 or hls", videoOutput)
+	}
+
+	renditionsSetting := os.Getenv("HLS_RENDITIONS")
+	if renditionsSetting == "" {
+		renditionsSetting = defaultRenditions
+	}
+	renditionLadder, err := parseRenditions(renditionsSetting)
+	if err != nil {
+		log.Fatalf("Invalid HLS_RENDITIONS: %v", err)
+	}
+
+	segmentTime := getEnvDuration("HLS_SEGMENT_DURATION", defaultSegmentTime)
+	if segmentTime < time.Second {
+		log.Fatal("HLS_SEGMENT_DURATION must be at least 1s")
+	}
+
+	thumbnailAt := os.Getenv("THUMBNAIL_AT")
+	if thumbnailAt == "" {
+		thumbnailAt = thumbnailAtAuto
+	}
+	if thumbnailAt != thumbnailAtAuto && thumbnailAt != thumbnailAtOff {
+		if _, err := parseVideoPosition(thumbnailAt, 0); err != nil {
+			log.Fatalf("Invalid THUMBNAIL_AT: %v", err)
+		}
+	}
+
+	thumbnailSizesSetting := os.Getenv("THUMBNAIL_SIZES")
+	if thumbnailSizesSetting == "" {
+		thumbnailSizesSetting = defaultThumbnailSizes
+	}
+	thumbnailSizes, err := parseThumbnailSizes(thumbnailSizesSetting)
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_SIZES: %v", err)
+	}
+
+	thumbnailCrop, err := parseThumbnailCrop(os.Getenv("THUMBNAIL_CROP"))
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_CROP: %v", err)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
+	thumbnailFormatsSetting := os.Getenv("THUMBNAIL_FORMATS")
+	if thumbnailFormatsSetting == "" {
+		thumbnailFormatsSetting = defaultThumbnailFormats
+	}
+	thumbnailFormats, err := parseThumbnailFormats(thumbnailFormatsSetting)
 	if err != nil {
-		log.Fatalf("Couldn't setup AWS configuration: %v", err)
-		return
+		log.Fatalf("Invalid THUMBNAIL_FORMATS: %v", err)
 	}
+	thumbnailFormats = availableThumbnailFormats(thumbnailFormats)
 
-	newS3Client := s3.NewFromConfig(awsCfg)
+	previewClipFormat := os.Getenv("PREVIEW_CLIP_FORMAT")
+	if previewClipFormat == "" {
+		previewClipFormat = previewClipMP4
+	}
+	if previewClipFormat != previewClipMP4 && previewClipFormat != previewClipWebP {
+		log.Fatalf("Unknown PREVIEW_CLIP_FORMAT %q, use mp4 or webp", previewClipFormat)
+	}
 
 	cfg := apiConfig{
 		db:               db,
@@ -105,7 +225,31 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
-		s3client:         *newS3Client,
+		storageBackend:   storageBackend,
+		store:            store,
+		tusDir:           tusDir,
+		tusLocks:         newUploadLocks(),
+		spoolDir:         spoolDir,
+		jobWake:          make(chan struct{}, 1),
+		runningJobs:      newRunningJobs(),
+		keyLocks:         newKeyLocks(),
+		progress:         newProgressHub(),
+		eventsTickets:    newEventsTickets(),
+		videoOutput:      videoOutput,
+		hlsKeepMP4:       getEnvBool("HLS_KEEP_MP4", false),
+		renditionLadder:  renditionLadder,
+		segmentTime:      segmentTime,
+		dashEnabled:      getEnvBool("DASH_ENABLED", false),
+		aspectTolerance:  getEnvFloat("ASPECT_TOLERANCE", defaultAspectTolerance),
+		thumbnailAt:      thumbnailAt,
+		thumbnailSizes:   thumbnailSizes,
+		thumbnailCrop:    thumbnailCrop,
+		thumbnailFormats: thumbnailFormats,
+		previewInterval:  getEnvDuration("PREVIEW_INTERVAL", defaultPreviewInterval),
+
+		previewClipDuration: getEnvDuration("PREVIEW_CLIP_DURATION", defaultPreviewClipDuration),
+		previewClipFormat:   previewClipFormat,
+		keepSource:          getEnvBool("KEEP_SOURCE", false),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -113,12 +257,25 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(cfg.runGCCommand(os.Args[2:]))
+	}
+
+	go cfg.runDeletionOutbox(context.Background(), deletionOutboxInterval)
+	go cfg.runTusCleanup(context.Background(), tusCleanupPeriod)
+	go cfg.runDirectUploadExpiry(context.Background(), tusCleanupPeriod)
+	cfg.runJobWorkers(context.Background(), getEnvInt("JOB_WORKERS", 2))
+
+	if gcInterval := getEnvDuration("GC_INTERVAL", 0); gcInterval > 0 {
+		go cfg.runPeriodicGC(context.Background(), gcInterval, getEnvDuration("GC_GRACE_PERIOD", defaultGCGracePeriod))
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	assetsHandler := http.StripPrefix("/assets", cfg.negotiateThumbnailFormat(http.FileServer(http.Dir(assetsRoot))))
+	mux.Handle("/assets/", assetsHandler)
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
@@ -128,19 +285,98 @@ func main() {
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_from_frame", cfg.handlerThumbnailFromFrame)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerUploadVideoPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerUploadVideoComplete)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/abort", cfg.handlerUploadVideoAbort)
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/videos/{videoID}", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/uploads/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/uploads/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/tus/uploads/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerJobGet)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	// mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatusGet)
+	mux.HandleFunc("POST /api/videos/{videoID}/events/ticket", cfg.handlerVideoEventsTicket)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
+	mux.HandleFunc("GET /api/thumbnails/{videoID}/{size}", cfg.handlerThumbnailGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
+	cacheRulesSetting := os.Getenv("CACHE_RULES")
+	if cacheRulesSetting == "" {
+		cacheRulesSetting = defaultCacheRules
+	}
+	cacheRules, err := parseCacheRules(cacheRulesSetting, getEnvDuration("CACHE_SHORT_MAX_AGE", defaultCacheShortMaxAge))
+	if err != nil {
+		log.Fatalf("Invalid CACHE_RULES: %v", err)
+	}
+	cache := &cachePolicy{rules: cacheRules}
+	if entries := getEnvInt("CACHE_LRU_ENTRIES", 0); entries > 0 {
+		cache.lru = newResponseCache(entries, getEnvInt("CACHE_LRU_MB", defaultCacheLRUMB)<<20)
+	}
+
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: cache.middleware(mux),
 	}
 
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// getEnvInt reads an optional integer setting, falling back to def when unset.
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a non-negative integer", name)
+	}
+	return n
+}
+
+// getEnvFloat reads an optional non-negative number such as "0.05".
+func getEnvFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Fatalf("%s must be a non-negative number", name)
+	}
+	return f
+}
+
+// getEnvBool reads an optional on/off setting such as "true" or "1".
+func getEnvBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be true or false", name)
+	}
+	return b
+}
+
+// getEnvDuration reads an optional duration setting such as "24h".
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration like 30s or 24h: %v", name, err)
+	}
+	return d
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	assetKindPreviewClip = "preview_clip"
+
+	previewClipMP4  = "mp4"
+	previewClipWebP = "webp"
+
+	defaultPreviewClipDuration = 3 * time.Second
+	previewClipWidth           = 320
+	previewClipFPS             = 15
+	// activitySampleFPS is how often frames are compared when looking for the
+	// busiest part of the video.
+	activitySampleFPS = 2
+)
+
+// sceneSample is ffmpeg's scene change score for a frame: 0 for a frame
+// identical to the one before, up to 1 for a cut.
+type sceneSample struct {
+	At    time.Duration
+	Score float64
+}
+
+// sampleSceneScores scores a low resolution, low frame rate copy of the
+// video, which is enough to tell still parts from busy ones.
+func sampleSceneScores(ctx context.Context, sourcePath string) ([]sceneSample, error) {
+	filter := fmt.Sprintf("fps=%d,scale=160:-2,select='gte(scene,0)',metadata=print:key=lavfi.scene_score:file=-", activitySampleFPS)
+	ffmpeg := mediaCommand(ctx, "ffmpeg", "-v", "error", "-i", sourcePath, "-an", "-vf", filter, "-f", "null", "-")
+	var stdout, stderr bytes.Buffer
+	ffmpeg.Stdout = &stdout
+	ffmpeg.Stderr = &stderr
+	if err := ffmpeg.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+
+	// metadata=print writes a "frame:N pts:N pts_time:S" line followed by
+	// the frame's "lavfi.scene_score=X".
+	samples := []sceneSample{}
+	var at time.Duration
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, ptsTime, ok := strings.Cut(line, "pts_time:"); ok {
+			fields := strings.Fields(ptsTime)
+			if len(fields) == 0 {
+				continue
+			}
+			seconds, err := strconv.ParseFloat(fields[0], 64)
+			if err == nil {
+				at = time.Duration(seconds * float64(time.Second))
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "lavfi.scene_score="); ok {
+			score, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				samples = append(samples, sceneSample{At: at, Score: score})
+			}
+		}
+	}
+	return samples, nil
+}
+
+// mostActiveSegment returns the start of the window of the given length
+// with the highest total scene score.
+func mostActiveSegment(samples []sceneSample, window, duration time.Duration) time.Duration {
+	if duration <= window || len(samples) == 0 {
+		return 0
+	}
+
+	var best time.Duration
+	bestScore, score := -1.0, 0.0
+	first := 0
+	for _, sample := range samples {
+		score += sample.Score
+		for samples[first].At <= sample.At-window {
+			score -= samples[first].Score
+			first++
+		}
+		start := samples[first].At
+		if start+window > duration {
+			break
+		}
+		if score > bestScore {
+			bestScore = score
+			best = start
+		}
+	}
+	return best
+}
+
+// encodePreviewClip cuts a muted, looping teaser out of the video.
+func encodePreviewClip(ctx context.Context, sourcePath, outPath, format string, start, length time.Duration) error {
+	filter := fmt.Sprintf("fps=%d,scale='min(%d,iw)':-2", previewClipFPS, previewClipWidth)
+	args := []string{"-v", "error", "-y", "-ss", formatSeconds(start), "-t", formatSeconds(length),
+		"-i", sourcePath, "-an", "-vf", filter}
+	switch format {
+	case previewClipWebP:
+		args = append(args, "-c:v", "libwebp", "-loop", "0", "-quality", "60", "-f", "webp")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "28", "-pix_fmt", "yuv420p",
+			"-movflags", "+faststart", "-f", "mp4")
+	}
+	args = append(args, outPath)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
+
+// addPreviewClip stores a teaser next to the video's main file, under
+// videoKey with a "-preview" suffix. Failures are logged and leave the video
+// without a preview.
+func (cfg *apiConfig) addPreviewClip(ctx context.Context, video database.Video, sourcePath, videoKey string, duration time.Duration) (database.Video, bool) {
+	video.PreviewURL = nil
+	if cfg.previewClipDuration <= 0 || duration <= 0 {
+		return video, false
+	}
+
+	samples, err := sampleSceneScores(ctx, sourcePath)
+	if err != nil {
+		log.Printf("Couldn't find the most active part of video %s: %v", video.ID, err)
+	}
+	length := min(cfg.previewClipDuration, duration)
+	start := mostActiveSegment(samples, length, duration)
+
+	clipPath := sourcePath + ".preview." + cfg.previewClipFormat
+	defer os.Remove(clipPath)
+	if err := encodePreviewClip(ctx, sourcePath, clipPath, cfg.previewClipFormat, start, length); err != nil {
+		log.Printf("Couldn't create preview clip for video %s: %v", video.ID, err)
+		return video, false
+	}
+
+	clip, err := os.Open(clipPath)
+	if err != nil {
+		log.Printf("Couldn't open preview clip for video %s: %v", video.ID, err)
+		return video, false
+	}
+	defer clip.Close()
+
+	clipKey := strings.TrimSuffix(videoKey, ".mp4") + "-preview." + cfg.previewClipFormat
+	contentType := "video/mp4"
+	if cfg.previewClipFormat == previewClipWebP {
+		contentType = "image/webp"
+	}
+	if err := cfg.store.Put(ctx, clipKey, clip, contentType); err != nil {
+		log.Printf("Couldn't store preview clip for video %s: %v", video.ID, err)
+		return video, false
+	}
+	if err := cfg.recordVideoAsset(video, assetKindPreviewClip, clipKey, false, nil); err != nil {
+		log.Printf("Couldn't record preview clip for video %s: %v", video.ID, err)
+		cfg.store.Delete(ctx, clipKey)
+		return video, false
+	}
+
+	previewURL := cfg.store.URL(clipKey)
+	video.PreviewURL = &previewURL
+	return video, true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	assetKindPreviews = "previews"
+	previewTrackName  = "thumbnails.vtt"
+
+	defaultPreviewInterval = 5 * time.Second
+	previewWidth           = 160
+	spriteColumns          = 10
+	spriteRows             = 10
+	// maxPreviewFrames caps the number of tiles for long videos by widening
+	// the interval.
+	maxPreviewFrames = 1000
+)
+
+// spriteLayout describes how preview frames are tiled into sprite sheets.
+type spriteLayout struct {
+	Interval time.Duration
+	Width    int
+	Height   int
+	Columns  int
+	Rows     int
+	Frames   int
+	Duration time.Duration
+}
+
+func newSpriteLayout(interval time.Duration, stream StreamInfo, duration time.Duration) spriteLayout {
+	if frames := duration / interval; frames > maxPreviewFrames {
+		interval = duration / maxPreviewFrames
+	}
+	width, height := stream.displaySize()
+	tileHeight := previewWidth * 9 / 16
+	if width > 0 && height > 0 {
+		tileHeight = int(math.Round(previewWidth*height/width/2)) * 2
+	}
+	return spriteLayout{
+		Interval: interval,
+		Width:    previewWidth,
+		Height:   max(tileHeight, 2),
+		Columns:  spriteColumns,
+		Rows:     spriteRows,
+		Frames:   max(1, int(math.Ceil(float64(duration)/float64(interval)))),
+		Duration: duration,
+	}
+}
+
+func (l spriteLayout) sheetName(sheet int) string {
+	return fmt.Sprintf("sprite_%03d.jpg", sheet)
+}
+
+// generateSprites writes the sprite sheets and a WebVTT track pointing into
+// them to outDir. Each cue covers one interval and names a tile with a media
+// fragment, e.g. "sprite_000.jpg#xywh=160,0,160,90".
+func generateSprites(ctx context.Context, sourcePath, outDir string, layout spriteLayout) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,setsar=1,tile=%dx%d",
+		formatSeconds(layout.Interval), layout.Width, layout.Height, layout.Columns, layout.Rows)
+	ffmpeg := mediaCommand(ctx, "ffmpeg", "-v", "error", "-y", "-i", sourcePath,
+		"-vf", filter, "-q:v", "4", "-start_number", "0",
+		filepath.Join(outDir, "sprite_%03d.jpg"))
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	track, err := os.Create(filepath.Join(outDir, previewTrackName))
+	if err != nil {
+		return err
+	}
+	defer track.Close()
+
+	w := bufio.NewWriter(track)
+	fmt.Fprint(w, "WEBVTT\n")
+	perSheet := layout.Columns * layout.Rows
+	for i := 0; i < layout.Frames; i++ {
+		start := time.Duration(i) * layout.Interval
+		end := min(start+layout.Interval, layout.Duration)
+		tile := i % perSheet
+		fmt.Fprintf(w, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTime(start), formatVTTTime(end), layout.sheetName(i/perSheet),
+			tile%layout.Columns*layout.Width, tile/layout.Columns*layout.Height, layout.Width, layout.Height)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return track.Close()
+}
+
+// formatVTTTime formats d as a WebVTT timestamp, e.g. "01:02:03.500".
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// storePreviewTrack generates the seek bar previews for a video and uploads
+// them under "previews/<videoID>/", returning the prefix.
+func (cfg *apiConfig) storePreviewTrack(ctx context.Context, video database.Video, sourcePath string, streams VideoInformation, duration time.Duration) (string, error) {
+	stream, ok := streams.videoStream()
+	if !ok || duration <= 0 {
+		return "", fmt.Errorf("video has no frames to preview")
+	}
+
+	workDir, err := os.MkdirTemp(cfg.spoolDir, "previews-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	layout := newSpriteLayout(cfg.previewInterval, stream, duration)
+	if err := generateSprites(ctx, sourcePath, workDir, layout); err != nil {
+		return "", err
+	}
+	return cfg.uploadPackage(ctx, video.ID, workDir, assetKindPreviews)
+}
+
+// addPreviewTrack sets the video's preview track, or clears it when it
+// couldn't be made; previews of an older upload would show the wrong frames.
+func (cfg *apiConfig) addPreviewTrack(ctx context.Context, video database.Video, sourcePath string, streams VideoInformation, duration time.Duration) (database.Video, string) {
+	video.PreviewTrackURL = nil
+	if cfg.previewInterval <= 0 {
+		return video, ""
+	}
+
+	prefix, err := cfg.storePreviewTrack(ctx, video, sourcePath, streams, duration)
+	if err != nil {
+		log.Printf("Couldn't create preview track for video %s: %v", video.ID, err)
+		return video, ""
+	}
+	if err := cfg.recordVideoAsset(video, assetKindPreviews, prefix, true, nil); err != nil {
+		log.Printf("Couldn't record preview track for video %s: %v", video.ID, err)
+		cfg.discardPackage(prefix)
+		return video, ""
+	}
+
+	trackURL := cfg.store.URL(path.Join(prefix, previewTrackName))
+	video.PreviewTrackURL = &trackURL
+	return video, prefix
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	progressStageUpload    = "upload"
+	progressStageTranscode = "transcode"
+	progressStageStore     = "store"
+	progressStageStatus    = "status"
+
+	// progressInterval throttles byte counters so a fast upload doesn't
+	// flood subscribers.
+	progressInterval = 250 * time.Millisecond
+	progressBuffer   = 32
+)
+
+// eventsTicketExpiry is how long a ticket for a video's event stream can be
+// redeemed.
+const eventsTicketExpiry = time.Minute
+
+// eventsTicket lets an EventSource, which can't send an Authorization
+// header, open one video's event stream once.
+type eventsTicket struct {
+	videoID   uuid.UUID
+	expiresAt time.Time
+}
+
+// eventsTickets holds the tickets issued by this process. Like the events
+// themselves, a ticket only works on the server that issued it.
+type eventsTickets struct {
+	mu      sync.Mutex
+	tickets map[string]eventsTicket
+}
+
+func newEventsTickets() *eventsTickets {
+	return &eventsTickets{tickets: map[string]eventsTicket{}}
+}
+
+func (t *eventsTickets) issue(videoID uuid.UUID) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := hex.EncodeToString(raw)
+	now := time.Now()
+	expiresAt := now.Add(eventsTicketExpiry)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, issued := range t.tickets {
+		if now.After(issued.expiresAt) {
+			delete(t.tickets, key)
+		}
+	}
+	t.tickets[ticket] = eventsTicket{videoID: videoID, expiresAt: expiresAt}
+	return ticket, expiresAt, nil
+}
+
+// redeem reports whether ticket is valid for videoID. A ticket can only be
+// redeemed once, so it is useless by the time it shows up in a log.
+func (t *eventsTickets) redeem(ticket string, videoID uuid.UUID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	issued, ok := t.tickets[ticket]
+	if !ok {
+		return false
+	}
+	delete(t.tickets, ticket)
+	return issued.videoID == videoID && time.Now().Before(issued.expiresAt)
+}
+
+// progressEvent is one update sent to the video's event stream. Total is -1
+// when the size isn't known; Percent is only set when it is.
+type progressEvent struct {
+	VideoID       uuid.UUID `json:"video_id"`
+	Stage         string    `json:"stage"`
+	Current       int64     `json:"current,omitempty"`
+	Total         int64     `json:"total,omitempty"`
+	Percent       float64   `json:"percent,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	FailureReason *string   `json:"failure_reason,omitempty"`
+}
+
+// progressHub fans progress events out to everyone watching a video. It only
+// lives in this process: events from a job running on another server aren't
+// seen here.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan progressEvent]struct{}
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{subs: map[uuid.UUID]map[chan progressEvent]struct{}{}}
+}
+
+func (h *progressHub) subscribe(videoID uuid.UUID) (<-chan progressEvent, func()) {
+	ch := make(chan progressEvent, progressBuffer)
+
+	h.mu.Lock()
+	if h.subs[videoID] == nil {
+		h.subs[videoID] = map[chan progressEvent]struct{}{}
+	}
+	h.subs[videoID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[videoID], ch)
+		if len(h.subs[videoID]) == 0 {
+			delete(h.subs, videoID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// publish never blocks: a subscriber that has fallen behind misses updates
+// rather than stalling an upload or a transcode.
+func (h *progressHub) publish(ev progressEvent) {
+	if ev.Total > 0 {
+		ev.Percent = min(100, float64(ev.Current)*100/float64(ev.Total))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[ev.VideoID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// reporter returns a throttled callback for a byte or time counter. The
+// final value (current == total) is always sent.
+func (h *progressHub) reporter(videoID uuid.UUID, stage string) func(current, total int64) {
+	var (
+		mu   sync.Mutex
+		last time.Time
+	)
+	return func(current, total int64) {
+		mu.Lock()
+		now := time.Now()
+		done := total > 0 && current >= total
+		if !done && now.Sub(last) < progressInterval {
+			mu.Unlock()
+			return
+		}
+		last = now
+		mu.Unlock()
+
+		h.publish(progressEvent{
+			VideoID: videoID,
+			Stage:   stage,
+			Current: current,
+			Total:   total,
+		})
+	}
+}
+
+// progressReader counts the bytes read through it.
+type progressReader struct {
+	r      io.Reader
+	read   int64
+	total  int64
+	report func(current, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.report(p.read, p.total)
+	return n, err
+}
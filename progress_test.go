@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEventsTickets(t *testing.T) {
+	tickets := newEventsTickets()
+	videoID := uuid.New()
+
+	ticket, expiresAt, err := tickets.issue(videoID)
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	if until := time.Until(expiresAt); until <= 0 || until > eventsTicketExpiry {
+		t.Errorf("ticket expires in %v, want within %v", until, eventsTicketExpiry)
+	}
+	if tickets.redeem(ticket, uuid.New()) {
+		t.Error("redeem() accepted the ticket for another video")
+	}
+
+	// A ticket is spent by any attempt, even one for the wrong video.
+	if tickets.redeem(ticket, videoID) {
+		t.Error("redeem() accepted a spent ticket")
+	}
+
+	ticket, _, err = tickets.issue(videoID)
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	if !tickets.redeem(ticket, videoID) {
+		t.Fatal("redeem() rejected a fresh ticket")
+	}
+	if tickets.redeem(ticket, videoID) {
+		t.Error("redeem() accepted a ticket twice")
+	}
+
+	expired, _, err := tickets.issue(videoID)
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	tickets.tickets[expired] = eventsTicket{videoID: videoID, expiresAt: time.Now().Add(-time.Second)}
+	if tickets.redeem(expired, videoID) {
+		t.Error("redeem() accepted an expired ticket")
+	}
+	if tickets.redeem("", videoID) {
+		t.Error("redeem() accepted an empty ticket")
+	}
+}
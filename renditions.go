@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	videoOutputMP4 = "mp4"
+	videoOutputHLS = "hls"
+
+	defaultRenditions     = "1080,720,480,360"
+	defaultSegmentTime    = 6 * time.Second
+	renditionAudioBitrate = "128k"
+)
+
+// renditionBitrates are the default video bitrates in kbit/s for common
+// rendition heights.
+var renditionBitrates = map[int]int{
+	2160: 12000,
+	1440: 8000,
+	1080: 5000,
+	720:  2800,
+	480:  1400,
+	360:  800,
+	240:  500,
+	144:  250,
+}
+
+// rendition is one rung of the rendition ladder. Height is the length of the
+// video's shorter side, so 720 means 1280x720 for landscape and 720x1280 for
+// portrait videos.
+type rendition struct {
+	Height  int
+	Bitrate int
+}
+
+func (r rendition) name() string {
+	return fmt.Sprintf("%dp", r.Height)
+}
+
+// parseRenditions reads a ladder like "1080,720,480" or "720:3000,360:600"
+// where the optional number after the colon is the bitrate in kbit/s.
+func parseRenditions(value string) ([]rendition, error) {
+	renditions := []rendition{}
+	seen := map[int]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		heightStr, bitrateStr, hasBitrate := strings.Cut(field, ":")
+		height, err := strconv.Atoi(strings.TrimSuffix(heightStr, "p"))
+		if err != nil || height <= 0 || height%2 != 0 {
+			return nil, fmt.Errorf("invalid rendition height %q", heightStr)
+		}
+		bitrate, ok := renditionBitrates[height]
+		if hasBitrate {
+			bitrate, err = strconv.Atoi(strings.TrimSuffix(bitrateStr, "k"))
+			if err != nil || bitrate <= 0 {
+				return nil, fmt.Errorf("invalid bitrate for %dp: %q", height, bitrateStr)
+			}
+		} else if !ok {
+			return nil, fmt.Errorf("no default bitrate for %dp, use %d:<kbit/s>", height, height)
+		}
+		if seen[height] {
+			continue
+		}
+		seen[height] = true
+		renditions = append(renditions, rendition{Height: height, Bitrate: bitrate})
+	}
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("no renditions given")
+	}
+	sort.Slice(renditions, func(i, j int) bool {
+		return renditions[i].Height > renditions[j].Height
+	})
+	return renditions, nil
+}
+
+// renditionsForSource drops renditions larger than the source. A source
+// smaller than every rendition gets a single one at its own size.
+func renditionsForSource(ladder []rendition, sourceHeight int) []rendition {
+	if sourceHeight <= 0 {
+		return ladder
+	}
+	renditions := []rendition{}
+	for _, r := range ladder {
+		if r.Height <= sourceHeight {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		smallest := ladder[len(ladder)-1]
+		renditions = append(renditions, rendition{
+			Height:  sourceHeight &^ 1,
+			Bitrate: smallest.Bitrate,
+		})
+	}
+	return renditions
+}
+
+// encodeRenditions encodes sourcePath into every rendition with a single
+// ffmpeg run, writing one MP4 per rendition to outDir. The HLS and DASH
+// packagers repackage these without re-encoding, so keyframes are forced on
+// segment boundaries for every rendition to be switchable at any segment.
+func encodeRenditions(ctx context.Context, sourcePath, outDir string, renditions []rendition, streams VideoInformation, segmentTime time.Duration, onProgress func(time.Duration)) ([]string, error) {
+	video, ok := streams.videoStream()
+	if !ok {
+		return nil, fmt.Errorf("no video stream found")
+	}
+	_, hasAudio := streams.audioStream()
+	width, height := video.orientedSize()
+	portrait := height > width
+
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, r := range renditions {
+		scale := fmt.Sprintf("scale=-2:%d", r.Height)
+		if portrait {
+			scale = fmt.Sprintf("scale=%d:-2", r.Height)
+		}
+		fmt.Fprintf(&filter, ";[v%d]%s[v%dout]", i, scale, i)
+	}
+
+	args := []string{"-v", "error", "-progress", "pipe:1", "-nostats", "-y",
+		"-i", sourcePath, "-filter_complex", filter.String()}
+	files := []string{}
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			"-c:v", "libx264",
+			"-b:v", fmt.Sprintf("%dk", r.Bitrate),
+			"-maxrate", fmt.Sprintf("%dk", r.Bitrate*107/100),
+			"-bufsize", fmt.Sprintf("%dk", r.Bitrate*3/2),
+			"-preset", "veryfast",
+			"-pix_fmt", "yuv420p",
+			"-force_key_frames", "expr:gte(t,n_forced*"+formatSeconds(segmentTime)+")",
+			"-sc_threshold", "0",
+		)
+		if hasAudio {
+			args = append(args, "-map", "0:a:0", "-c:a", "aac", "-b:a", renditionAudioBitrate, "-ac", "2")
+		}
+		file := filepath.Join(outDir, r.name()+".mp4")
+		args = append(args, "-f", "mp4", file)
+		files = append(files, file)
+	}
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, onProgress); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return files, nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// uploadDirectory stores every file below dir under prefix, keeping the
+// relative paths. Progress is reported for the directory as a whole.
+func (cfg *apiConfig) uploadDirectory(ctx context.Context, dir, prefix string, report func(current, total int64)) error {
+	type file struct {
+		path string
+		key  string
+		size int64
+	}
+	files := []file{}
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{path: p, key: prefix + filepath.ToSlash(rel), size: info.Size()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var done int64
+	for _, f := range files {
+		body, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		fileCtx := storage.WithProgress(ctx, func(written, _ int64) {
+			report(done+written, total)
+		})
+		err = cfg.store.Put(fileCtx, f.key, body, contentTypeForKey(f.key))
+		body.Close()
+		if err != nil {
+			return err
+		}
+		done += f.size
+	}
+	return nil
+}
+
+func contentTypeForKey(key string) string {
+	switch path.Ext(key) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".mp4":
+		return "video/mp4"
+	case ".vtt":
+		return "text/vtt"
+	case ".jpg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	case ".avif":
+		return "image/avif"
+	}
+	return "application/octet-stream"
+}
+
+// adaptiveStreams are the storage prefixes of a video's packaged renditions.
+// A prefix is empty when that format is turned off.
+type adaptiveStreams struct {
+	HLSPrefix  string
+	DASHPrefix string
+}
+
+// storeAdaptiveStreams encodes the source into the rendition ladder once,
+// packages it as HLS and/or DASH, and uploads each package under a fresh
+// prefix below the video's own.
+func (cfg *apiConfig) storeAdaptiveStreams(ctx context.Context, videoID uuid.UUID, sourcePath string, streams VideoInformation, duration time.Duration) (adaptiveStreams, error) {
+	result := adaptiveStreams{}
+
+	workDir, err := os.MkdirTemp(cfg.spoolDir, "renditions-*")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(workDir)
+
+	video, _ := streams.videoStream()
+	_, hasAudio := streams.audioStream()
+	renditions := renditionsForSource(cfg.renditionLadder, min(video.orientedSize()))
+
+	reportTranscode := cfg.progress.reporter(videoID, progressStageTranscode)
+	files, err := encodeRenditions(ctx, sourcePath, workDir, renditions, streams, cfg.segmentTime, func(outTime time.Duration) {
+		reportTranscode(outTime.Milliseconds(), duration.Milliseconds())
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if cfg.videoOutput == videoOutputHLS {
+		hlsDir := filepath.Join(workDir, assetKindHLS)
+		if err := packageHLS(ctx, files, renditions, hasAudio, hlsDir, cfg.segmentTime); err != nil {
+			return result, fmt.Errorf("couldn't package HLS: %w", err)
+		}
+		result.HLSPrefix, err = cfg.uploadPackage(ctx, videoID, hlsDir, assetKindHLS)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if cfg.dashEnabled {
+		dashDir := filepath.Join(workDir, assetKindDASH)
+		if err := packageDASH(ctx, files, hasAudio, dashDir, cfg.segmentTime); err != nil {
+			cfg.discardPackage(result.HLSPrefix)
+			return result, fmt.Errorf("couldn't package DASH: %w", err)
+		}
+		result.DASHPrefix, err = cfg.uploadPackage(ctx, videoID, dashDir, assetKindDASH)
+		if err != nil {
+			cfg.discardPackage(result.HLSPrefix)
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// uploadPackage stores a packaged directory below "<kind>/<videoID>/" and
+// returns its prefix. A partial upload is removed again.
+func (cfg *apiConfig) uploadPackage(ctx context.Context, videoID uuid.UUID, dir, kind string) (string, error) {
+	prefix := newAssetPrefix(path.Join(kind, videoID.String()))
+	err := cfg.uploadDirectory(ctx, dir, prefix, cfg.progress.reporter(videoID, progressStageStore))
+	if err != nil {
+		cfg.discardPackage(prefix)
+		return "", fmt.Errorf("couldn't upload %s output: %w", kind, err)
+	}
+	return prefix, nil
+}
+
+func (cfg *apiConfig) discardPackage(prefix string) {
+	if prefix == "" {
+		return
+	}
+	if err := cfg.deleteStoredObject(context.Background(), prefix, true); err != nil {
+		log.Printf("Couldn't remove partial upload %s: %v", prefix, err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	thumbnailAtAuto = "auto"
+	thumbnailAtOff  = "off"
+
+	// posterSceneThreshold is the ffmpeg scene score a frame needs to count
+	// as the start of a new shot.
+	posterSceneThreshold = 0.3
+	posterSearchWindow   = 60 * time.Second
+	posterMaxWidth       = 1280
+)
+
+// thumbnailExtensions maps the image types accepted as thumbnails, as
+// detected by http.DetectContentType, to their file extensions.
+var thumbnailExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+	"image/gif":  "gif",
+}
+
+// sniffImage detects the media type of an image from its first bytes. The
+// returned reader yields the whole image again, including the sniffed bytes.
+func sniffImage(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// storeThumbnail resizes a thumbnail image into THUMBNAIL_SIZES and points
+// the video at the renditions. Automatic thumbnails only replace other
+// automatic ones, so ok is false when the owner had picked a thumbnail in the
+// meantime and nothing was changed.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, video database.Video, body io.Reader, mediaType, source string) (database.Video, bool, error) {
+	original, err := os.CreateTemp("", "thumbnail-*")
+	if err != nil {
+		return video, false, err
+	}
+	defer os.Remove(original.Name())
+	defer original.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(original, digest), body); err != nil {
+		return video, false, fmt.Errorf("couldn't read image: %w", err)
+	}
+
+	prefix, thumbnail, err := cfg.storeThumbnailSizes(ctx, video, original.Name(), mediaType, digest.Sum(nil))
+	if err != nil {
+		return video, false, fmt.Errorf("couldn't save image: %w", err)
+	}
+
+	thumbnail.Source = source
+	updated, err := cfg.db.SetVideoThumbnail(video.ID, thumbnail, source == database.ThumbnailSourceAuto)
+	if err == nil && !updated {
+		err = cfg.discardThumbnail(ctx, video, prefix)
+		return video, false, err
+	}
+	if err != nil {
+		if discardErr := cfg.discardThumbnail(ctx, video, prefix); discardErr != nil {
+			log.Printf("Couldn't remove unused thumbnail %s: %v", prefix, discardErr)
+		}
+		return video, false, fmt.Errorf("couldn't update video thumbnail: %w", err)
+	}
+
+	err = cfg.recordVideoAsset(video, assetKindThumbnail, prefix, true, video.ThumbnailURL)
+	if err != nil {
+		return video, true, fmt.Errorf("couldn't record thumbnail: %w", err)
+	}
+
+	video.ThumbnailURL = &thumbnail.URL
+	video.ThumbnailSource = &source
+	video.Thumbnails = thumbnail.Sizes
+	video.ThumbnailSrcset = database.ThumbnailSrcset(thumbnail.Sizes)
+	video.ThumbnailSources = thumbnail.Sources
+	video.ThumbnailBlurhash = thumbnail.Blurhash
+	video.ThumbnailVersion = &thumbnail.Version
+	cfg.retireVideoAssets(ctx, video, assetKindThumbnail)
+	return video, true, nil
+}
+
+// discardThumbnail removes renditions that weren't used, unless the video
+// still tracks the same content-addressed prefix as one of its thumbnails.
+func (cfg *apiConfig) discardThumbnail(ctx context.Context, video database.Video, prefix string) error {
+	assets, err := cfg.db.GetVideoAssets(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, asset := range assets {
+		if asset.Key == prefix {
+			return nil
+		}
+	}
+	return cfg.deleteStoredObject(ctx, prefix, true)
+}
+
+// autoThumbnail extracts a poster frame from a freshly processed video
+// unless its owner already chose a thumbnail. Failures are only logged: a
+// missing poster isn't worth failing the upload for.
+func (cfg *apiConfig) autoThumbnail(ctx context.Context, video database.Video, sourcePath string, duration time.Duration) database.Video {
+	if cfg.thumbnailAt == thumbnailAtOff {
+		return video
+	}
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		log.Printf("Couldn't check thumbnail of video %s: %v", video.ID, err)
+		return video
+	}
+	video.ThumbnailURL = current.ThumbnailURL
+	video.ThumbnailSource = current.ThumbnailSource
+	isAuto := current.ThumbnailSource != nil && *current.ThumbnailSource == database.ThumbnailSourceAuto
+	if current.ThumbnailURL != nil && !isAuto {
+		return video
+	}
+
+	posterPath, err := cfg.extractPosterFrame(ctx, sourcePath, duration)
+	if err != nil {
+		log.Printf("Couldn't extract a poster frame for video %s: %v", video.ID, err)
+		return video
+	}
+	defer os.Remove(posterPath)
+
+	poster, err := os.Open(posterPath)
+	if err != nil {
+		log.Printf("Couldn't open poster frame for video %s: %v", video.ID, err)
+		return video
+	}
+	defer poster.Close()
+
+	updated, _, err := cfg.storeThumbnail(ctx, video, poster, "image/jpeg", database.ThumbnailSourceAuto)
+	if err != nil {
+		log.Printf("Couldn't store poster frame for video %s: %v", video.ID, err)
+		return video
+	}
+	return updated
+}
+
+// extractPosterFrame writes a JPEG poster for the video to a temporary file.
+// With THUMBNAIL_AT=auto it takes the first shot change after the opening
+// tenth of the video, which skips fades from black and title cards, and falls
+// back to ffmpeg's most representative frame near that point.
+func (cfg *apiConfig) extractPosterFrame(ctx context.Context, sourcePath string, duration time.Duration) (string, error) {
+	outPath := sourcePath + ".poster.jpg"
+	os.Remove(outPath)
+
+	err := cfg.extractPosterFrameTo(ctx, sourcePath, outPath, duration)
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	return outPath, nil
+}
+
+func (cfg *apiConfig) extractPosterFrameTo(ctx context.Context, sourcePath, outPath string, duration time.Duration) error {
+	if cfg.thumbnailAt != thumbnailAtAuto {
+		at, err := parseVideoPosition(cfg.thumbnailAt, duration)
+		if err != nil {
+			return err
+		}
+		if duration > 0 && at >= duration {
+			at = duration / 2
+		}
+		return extractFrame(ctx, sourcePath, outPath, at, "")
+	}
+
+	start := duration / 10
+	window := min(posterSearchWindow, duration-start)
+	scene := fmt.Sprintf("select='gt(scene,%g)'", posterSceneThreshold)
+	err := extractFrame(ctx, sourcePath, outPath, start, scene, "-t", formatSeconds(window))
+	if err == nil {
+		if info, statErr := os.Stat(outPath); statErr == nil && info.Size() > 0 {
+			return nil
+		}
+	}
+	return extractFrame(ctx, sourcePath, outPath, start, "thumbnail")
+}
+
+// extractFrame writes the first frame at or after at that passes filter.
+// sourcePath may also be a URL, which ffmpeg reads with range requests.
+func extractFrame(ctx context.Context, sourcePath, outPath string, at time.Duration, filter string, inputArgs ...string) error {
+	filters := fmt.Sprintf("scale='min(%d,iw)':-2", posterMaxWidth)
+	if filter != "" {
+		filters = filter + "," + filters
+	}
+	args := []string{"-v", "error", "-y", "-ss", formatSeconds(at)}
+	args = append(args, inputArgs...)
+	args = append(args, "-i", sourcePath, "-vf", filters, "-frames:v", "1", "-q:v", "2", "-f", "image2", outPath)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
+
+// parseVideoPosition reads a position like "5s", "1m30s", "12.5" (seconds)
+// or "25%" of the video.
+func parseVideoPosition(value string, duration time.Duration) (time.Duration, error) {
+	var at time.Duration
+	switch {
+	case strings.HasSuffix(value, "%"):
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid position %q", value)
+		}
+		at = time.Duration(float64(duration) * percent / 100)
+	default:
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			at = time.Duration(seconds * float64(time.Second))
+			break
+		}
+		at, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid position %q", value)
+		}
+	}
+	if at < 0 {
+		return 0, fmt.Errorf("invalid position %q", value)
+	}
+	return at, nil
+}
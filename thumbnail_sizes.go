@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/blurhash"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	defaultThumbnailSizes   = "320,640,1280"
+	defaultThumbnailFormats = "avif,webp"
+	thumbnailCropNone       = "none"
+	thumbnailFormatsNone    = "none"
+
+	// blurhashComponents is the number of placeholder components along the
+	// longer side of the thumbnail, one less along the shorter side.
+	blurhashComponents = 4
+)
+
+// thumbnailEncoders are the ffmpeg output options of each thumbnail format,
+// by file extension. JPEG and PNG are the fallbacks every browser shows;
+// AVIF and WebP are offered to browsers that ask for them.
+var thumbnailEncoders = map[string][]string{
+	"jpg":  {"-q:v", "3", "-f", "image2"},
+	"png":  {"-f", "image2"},
+	"webp": {"-c:v", "libwebp", "-quality", "80", "-f", "image2"},
+	"avif": {"-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-b:v", "0", "-f", "avif"},
+}
+
+// thumbnailFormatEncoders names the ffmpeg encoder each modern format needs.
+var thumbnailFormatEncoders = map[string]string{
+	"webp": "libwebp",
+	"avif": "libaom-av1",
+}
+
+// availableThumbnailFormats drops the formats whose encoder the installed
+// ffmpeg lacks, so a build without libaom or libwebp still makes thumbnails
+// in the fallback format. It runs ffmpeg once, at startup.
+func availableThumbnailFormats(formats []string) []string {
+	if len(formats) == 0 {
+		return formats
+	}
+	out, err := mediaCommand(context.Background(), "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		log.Printf("Couldn't list ffmpeg encoders, thumbnails will only use the fallback format: %v", err)
+		return []string{}
+	}
+	encoders := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// Lines look like " V....D libwebp   libwebp WebP image".
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+
+	available := []string{}
+	for _, format := range formats {
+		if !encoders[thumbnailFormatEncoders[format]] {
+			log.Printf("ffmpeg has no %s encoder, thumbnails won't be offered as %s", thumbnailFormatEncoders[format], format)
+			continue
+		}
+		available = append(available, format)
+	}
+	return available
+}
+
+// parseThumbnailSizes reads THUMBNAIL_SIZES, a list of rendition widths in
+// pixels such as "320,640,1280". The widths are returned smallest first.
+func parseThumbnailSizes(value string) ([]int, error) {
+	sizes := []int{}
+	seen := map[int]bool{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		width, err := strconv.Atoi(strings.TrimSuffix(field, "w"))
+		if err != nil || width <= 0 || width%2 != 0 {
+			return nil, fmt.Errorf("invalid thumbnail width %q", field)
+		}
+		if seen[width] {
+			continue
+		}
+		seen[width] = true
+		sizes = append(sizes, width)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no thumbnail sizes given")
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// parseThumbnailCrop reads THUMBNAIL_CROP: "none" keeps the image's shape,
+// and a ratio like "16:9" or "1:1" cuts the largest centered area of that
+// shape out of it before resizing.
+func parseThumbnailCrop(value string) (string, error) {
+	if value == "" || value == thumbnailCropNone {
+		return thumbnailCropNone, nil
+	}
+	if _, _, ok := parseRatio(value); !ok {
+		return "", fmt.Errorf("invalid crop %q, use none or a ratio like 16:9", value)
+	}
+	return value, nil
+}
+
+// parseThumbnailFormats reads THUMBNAIL_FORMATS, the modern formats
+// thumbnails are encoded in next to their fallback, most preferred first.
+func parseThumbnailFormats(value string) ([]string, error) {
+	formats := []string{}
+	if value == thumbnailFormatsNone {
+		return formats, nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		format := strings.ToLower(strings.TrimSpace(field))
+		if format == "" || slices.Contains(formats, format) {
+			continue
+		}
+		if format != "avif" && format != "webp" {
+			return nil, fmt.Errorf("unknown thumbnail format %q, use avif or webp", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// cropFilter returns the ffmpeg filter for crop, or "" when the image
+// keeps its shape. ffmpeg centers the crop area by default.
+func cropFilter(crop string) string {
+	w, h, ok := parseRatio(crop)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("crop=w='min(iw,ih*%g/%g)':h='min(ih,iw*%g/%g)'", w, h, h, w)
+}
+
+// croppedWidth is the width of a width x height image after crop.
+func croppedWidth(width, height int, crop string) int {
+	w, h, ok := parseRatio(crop)
+	if !ok || height <= 0 {
+		return width
+	}
+	return min(width, int(float64(height)*w/h))
+}
+
+// thumbnailSizesForSource drops widths larger than the image, so nothing is
+// scaled up. An image narrower than every size gets one at its own width,
+// and one of unknown width only gets the smallest size.
+func thumbnailSizesForSource(sizes []int, sourceWidth int) []int {
+	if sourceWidth <= 0 {
+		return sizes[:1]
+	}
+	fitting := []int{}
+	for _, width := range sizes {
+		if width <= sourceWidth {
+			fitting = append(fitting, width)
+		}
+	}
+	if len(fitting) == 0 {
+		fitting = append(fitting, sourceWidth-sourceWidth%2)
+	}
+	return fitting
+}
+
+// decodedImageSize reads the dimensions from the image header when ffprobe
+// didn't report them. It returns zeros for formats Go can't decode.
+func decodedImageSize(sourcePath string) (int, int) {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// thumbnailFallbackExt picks the format every browser gets: JPEGs stay
+// JPEG, and other images become PNG since they may be transparent.
+func thumbnailFallbackExt(mediaType string) string {
+	if mediaType == "image/jpeg" {
+		return "jpg"
+	}
+	return "png"
+}
+
+// resizeThumbnail decodes the image at sourcePath once, turns it upright
+// and writes one rendition per width and format to dir, named
+// "<width>.<ext>". Metadata such as EXIF and GPS tags isn't copied, and
+// animated images only keep their first frame.
+func resizeThumbnail(ctx context.Context, sourcePath, dir string, widths []int, crop string, orientation int, formats []string) error {
+	filters := []string{}
+	if filter := orientationFilter(orientation); filter != "" {
+		filters = append(filters, filter)
+	}
+	if filter := cropFilter(crop); filter != "" {
+		filters = append(filters, filter)
+	}
+	outputCount := len(widths) * len(formats)
+	splits := ""
+	for i := 0; i < outputCount; i++ {
+		splits += fmt.Sprintf("[s%d]", i)
+	}
+	filters = append(filters, fmt.Sprintf("split=%d%s", outputCount, splits))
+	graph := "[0:v]" + strings.Join(filters, ",")
+
+	// The orientation is applied by the filter above, so ffmpeg mustn't
+	// rotate the input on its own as well.
+	args := []string{"-v", "error", "-y", "-noautorotate", "-i", sourcePath}
+	outputs := []string{}
+	i := 0
+	for _, width := range widths {
+		for _, ext := range formats {
+			graph += fmt.Sprintf(";[s%d]scale=%d:-2:flags=lanczos[o%d]", i, width, i)
+			outputs = append(outputs, "-map", fmt.Sprintf("[o%d]", i), "-map_metadata", "-1", "-frames:v", "1")
+			outputs = append(outputs, thumbnailEncoders[ext]...)
+			outputs = append(outputs, filepath.Join(dir, fmt.Sprintf("%d.%s", width, ext)))
+			i++
+		}
+	}
+	args = append(args, "-filter_complex", graph)
+	args = append(args, outputs...)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	if err := runFFmpegWithProgress(ffmpeg, nil); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	return nil
+}
+
+// storeThumbnailSizes resizes the image at sourcePath into THUMBNAIL_SIZES
+// in the fallback format and THUMBNAIL_FORMATS, and uploads the renditions
+// under a content-addressed prefix. It returns the prefix and the stored
+// thumbnail.
+func (cfg *apiConfig) storeThumbnailSizes(ctx context.Context, video database.Video, sourcePath, mediaType string, sourceDigest []byte) (string, database.SetVideoThumbnailParams, error) {
+	thumbnail := database.SetVideoThumbnailParams{}
+	info, err := probeVideo(ctx, sourcePath)
+	if err != nil {
+		return "", thumbnail, fmt.Errorf("couldn't read image: %w", err)
+	}
+	stream, _ := info.videoStream()
+	orientation := readExifOrientation(sourcePath)
+	width, height := stream.Width, stream.Height
+	if width <= 0 || height <= 0 {
+		width, height = decodedImageSize(sourcePath)
+	}
+	if orientationSwapsSides(orientation) {
+		width, height = height, width
+	}
+	widths := thumbnailSizesForSource(cfg.thumbnailSizes, croppedWidth(width, height, cfg.thumbnailCrop))
+
+	dir, err := os.MkdirTemp("", "thumbnail-*")
+	if err != nil {
+		return "", thumbnail, err
+	}
+	defer os.RemoveAll(dir)
+
+	fallback := thumbnailFallbackExt(mediaType)
+	formats := append([]string{fallback}, cfg.thumbnailFormats...)
+	err = resizeThumbnail(ctx, sourcePath, dir, widths, cfg.thumbnailCrop, orientation, formats)
+	if err != nil && len(formats) > 1 {
+		// Browsers can do without the modern formats, so encode one format
+		// at a time and keep whichever work, as long as the fallback does.
+		err = resizeThumbnail(ctx, sourcePath, dir, widths, cfg.thumbnailCrop, orientation, formats[:1])
+		if err == nil {
+			encoded := []string{fallback}
+			for _, ext := range formats[1:] {
+				extErr := resizeThumbnail(ctx, sourcePath, dir, widths, cfg.thumbnailCrop, orientation, []string{ext})
+				if extErr != nil {
+					log.Printf("Couldn't encode thumbnail of video %s as %s: %v", video.ID, ext, extErr)
+					for _, width := range widths {
+						os.Remove(filepath.Join(dir, fmt.Sprintf("%d.%s", width, ext)))
+					}
+					continue
+				}
+				encoded = append(encoded, ext)
+			}
+			formats = encoded
+		}
+	}
+	if err != nil {
+		return "", thumbnail, err
+	}
+
+	// The same image rendered with the same settings always ends up under
+	// the same key, so the objects never change once stored.
+	thumbnail.Version = thumbnailVersion(sourceDigest, widths, cfg.thumbnailCrop, formats)
+	prefix := path.Join("thumbnails", video.ID.String(), thumbnail.Version) + "/"
+
+	// An earlier copy of this prefix may still be queued for deletion; take
+	// it out of the outbox before the objects are stored again.
+	unlock := cfg.keyLocks.lock(prefix)
+	defer unlock()
+	if err := cfg.db.CancelPendingDeletion(prefix); err != nil {
+		return "", thumbnail, err
+	}
+	err = cfg.uploadDirectory(ctx, dir, prefix, func(current, total int64) {})
+	if err != nil {
+		if discardErr := cfg.discardThumbnail(context.Background(), video, prefix); discardErr != nil {
+			log.Printf("Couldn't remove partial thumbnail %s: %v", prefix, discardErr)
+		}
+		return "", thumbnail, fmt.Errorf("couldn't upload thumbnails: %w", err)
+	}
+
+	urls := func(ext string) map[int]string {
+		sizes := map[int]string{}
+		for _, width := range widths {
+			sizes[width] = cfg.store.URL(fmt.Sprintf("%s%d.%s", prefix, width, ext))
+		}
+		return sizes
+	}
+	thumbnail.Blurhash = thumbnailBlurhash(filepath.Join(dir, fmt.Sprintf("%d.%s", widths[0], fallback)))
+	thumbnail.Sizes = urls(fallback)
+	thumbnail.URL = thumbnail.Sizes[widths[len(widths)-1]]
+	for _, ext := range formats[1:] {
+		sizes := urls(ext)
+		thumbnail.Sources = append(thumbnail.Sources, database.ThumbnailSource{
+			Type:   contentTypeForKey("." + ext),
+			Sizes:  sizes,
+			Srcset: *database.ThumbnailSrcset(sizes),
+		})
+	}
+	return prefix, thumbnail, nil
+}
+
+// thumbnailVersion identifies a thumbnail by the digest of the source image
+// and the settings its renditions were made with.
+func thumbnailVersion(sourceDigest []byte, widths []int, crop string, formats []string) string {
+	hash := sha256.New()
+	hash.Write(sourceDigest)
+	fmt.Fprintf(hash, "%v|%s|%v", widths, crop, formats)
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// thumbnailBlurhash computes the placeholder of a JPEG or PNG rendition.
+// It returns nil when that fails, since a thumbnail without a placeholder
+// is still worth storing.
+func thumbnailBlurhash(renditionPath string) *string {
+	file, err := os.Open(renditionPath)
+	if err != nil {
+		log.Printf("Couldn't open %s for its placeholder: %v", renditionPath, err)
+		return nil
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		log.Printf("Couldn't decode %s for its placeholder: %v", renditionPath, err)
+		return nil
+	}
+	xComponents, yComponents := blurhashComponents, blurhashComponents-1
+	if bounds := img.Bounds(); bounds.Dy() > bounds.Dx() {
+		xComponents, yComponents = yComponents, xComponents
+	}
+	hash, err := blurhash.Encode(img, xComponents, yComponents)
+	if err != nil {
+		log.Printf("Couldn't compute placeholder of %s: %v", renditionPath, err)
+		return nil
+	}
+	return &hash
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,termination,expiration"
+	tusUploadExpiry  = 24 * time.Hour
+	tusCleanupPeriod = time.Hour
+)
+
+// uploadLocks serializes PATCH requests per upload so concurrent clients
+// can't interleave writes to the same file.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*sync.Mutex
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locks: map[uuid.UUID]*sync.Mutex{}}
+}
+
+func (l *uploadLocks) lock(id uuid.UUID) func() {
+	l.mu.Lock()
+	m, ok := l.locks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[id] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+func (l *uploadLocks) forget(id uuid.UUID) {
+	l.mu.Lock()
+	delete(l.locks, id)
+	l.mu.Unlock()
+}
+
+func (cfg *apiConfig) tusUploadPath(id uuid.UUID) string {
+	return filepath.Join(cfg.tusDir, id.String())
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, bool) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, true
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, false
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, false
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, true
+}
+
+// runTusCleanup removes uploads that stopped receiving data before they
+// completed, along with their partial files.
+func (cfg *apiConfig) runTusCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := cfg.db.GetStaleTusUploads(time.Now().Add(-tusUploadExpiry))
+		if err != nil {
+			log.Printf("Couldn't load stale uploads: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			upload, err := cfg.db.GetTusUpload(id)
+			if err != nil {
+				log.Printf("Couldn't load stale upload %s: %v", id, err)
+				continue
+			}
+			if err := os.Remove(cfg.tusUploadPath(id)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Couldn't remove stale upload %s: %v", id, err)
+				continue
+			}
+			if err := cfg.db.DeleteTusUpload(id); err != nil {
+				log.Printf("Couldn't delete stale upload %s: %v", id, err)
+			}
+			cfg.tusLocks.forget(id)
+			cfg.restoreVideoStatus(upload.VideoID)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+type VideoInformation struct {
+	Data   []StreamInfo `json:"streams"`
+	Format FormatInfo   `json:"format"`
+}
+
+type StreamInfo struct {
+	CodecType    string `json:"codec_type"`
+	CodecName    string `json:"codec_name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	AspectRatio  string `json:"display_aspect_ratio"`
+	AvgFrameRate string `json:"avg_frame_rate"`
+	Channels     int    `json:"channels"`
+
+	SampleAspectRatio string `json:"sample_aspect_ratio"`
+	Tags              struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideData []struct {
+		Type     string  `json:"side_data_type"`
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// FormatInfo is ffprobe's description of the container. ffprobe reports
+// the numbers as strings.
+type FormatInfo struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+	Tags       struct {
+		MajorBrand string `json:"major_brand"`
+	} `json:"tags"`
+}
+
+func (info VideoInformation) videoStream() (StreamInfo, bool) {
+	return info.firstStream("video")
+}
+
+func (info VideoInformation) audioStream() (StreamInfo, bool) {
+	return info.firstStream("audio")
+}
+
+func (info VideoInformation) firstStream(codecType string) (StreamInfo, bool) {
+	for _, stream := range info.Data {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return StreamInfo{}, false
+}
+
+func (info VideoInformation) duration() time.Duration {
+	seconds, _ := strconv.ParseFloat(info.Format.Duration, 64)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// metadata collects what gets stored on the video record.
+func (info VideoInformation) metadata() database.VideoMetadata {
+	meta := database.VideoMetadata{
+		DurationSeconds: info.duration().Seconds(),
+		Container:       info.Format.FormatName,
+	}
+	meta.BitRate, _ = strconv.ParseInt(info.Format.BitRate, 10, 64)
+	meta.FileSize, _ = strconv.ParseInt(info.Format.Size, 10, 64)
+
+	if video, ok := info.videoStream(); ok {
+		meta.Width, meta.Height = video.orientedSize()
+		meta.VideoCodec = video.CodecName
+		meta.FrameRate = parseFrameRate(video.AvgFrameRate)
+	}
+	if audio, ok := info.audioStream(); ok {
+		meta.AudioCodec = audio.CodecName
+		meta.AudioChannels = audio.Channels
+	}
+	return meta
+}
+
+// parseFrameRate turns ffprobe's "30000/1001" into 29.97.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(rate, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return math.Round(n/d*1000) / 1000
+}
+
+// processAndStoreVideo turns a local copy of an uploaded MP4 into the video's
+// current file in storage and returns the updated record.
+func (cfg *apiConfig) processAndStoreVideo(ctx context.Context, video database.Video, sourcePath string) (database.Video, error) {
+	streams, err := probeUpload(ctx, sourcePath)
+	if err != nil {
+		var unsupported unsupportedVideoError
+		if errors.As(err, &unsupported) {
+			return video, fmt.Errorf("%w: %w", errJobAbandoned, err)
+		}
+		return video, err
+	}
+
+	duration := streams.duration()
+	videoKey := newAssetKey(streams.aspectCategory(cfg.aspectTolerance), "mp4")
+
+	// With HLS, players get the ladder and the MP4 would only take up space
+	// and transcoding time, so it is only stored when asked for.
+	var newURL string
+	hasMP4 := cfg.videoOutput != videoOutputHLS || cfg.hlsKeepMP4
+	if hasMP4 {
+		if err := cfg.storeMP4(ctx, video, sourcePath, streams, videoKey); err != nil {
+			return video, err
+		}
+		newURL = cfg.store.URL(videoKey)
+	}
+
+	var packages adaptiveStreams
+	if cfg.videoOutput == videoOutputHLS || cfg.dashEnabled {
+		packages, err = cfg.storeAdaptiveStreams(ctx, video.ID, sourcePath, streams, duration)
+		if err != nil {
+			return video, fmt.Errorf("couldn't create renditions: %w", err)
+		}
+	}
+	if packages.HLSPrefix != "" {
+		err = cfg.recordVideoAsset(video, assetKindHLS, packages.HLSPrefix, true, nil)
+		if err != nil {
+			return video, fmt.Errorf("couldn't record HLS renditions: %w", err)
+		}
+		newURL = cfg.store.URL(packages.HLSPrefix + hlsMasterPlaylist)
+	}
+	if packages.DASHPrefix != "" {
+		err = cfg.recordVideoAsset(video, assetKindDASH, packages.DASHPrefix, true, nil)
+		if err != nil {
+			return video, fmt.Errorf("couldn't record DASH renditions: %w", err)
+		}
+		dashURL := cfg.store.URL(packages.DASHPrefix + dashManifest)
+		video.DashURL = &dashURL
+	} else {
+		video.DashURL = nil
+	}
+	video.VideoURL = &newURL
+
+	video, previewPrefix := cfg.addPreviewTrack(ctx, video, sourcePath, streams, duration)
+	video, hasPreviewClip := cfg.addPreviewClip(ctx, video, sourcePath, videoKey, duration)
+	video, hasSource, err := cfg.keepSourceFile(ctx, video, sourcePath, streams)
+	if err != nil {
+		return video, err
+	}
+
+	err = cfg.db.UpdateVideoOutputs(video)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video url: %w", err)
+	}
+	meta := streams.metadata()
+	err = cfg.db.UpdateVideoMetadata(video.ID, meta)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video metadata: %w", err)
+	}
+	video.Metadata = &meta
+
+	video = cfg.autoThumbnail(ctx, video, sourcePath, duration)
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady, nil)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video status: %w", err)
+	}
+	video.Status = database.VideoStatusReady
+	video.FailureReason = nil
+	cfg.publishVideoStatus(video.ID, video.Status, nil)
+
+	cfg.retireOutputAssets(ctx, video, assetKindVideo, hasMP4)
+	cfg.retireOutputAssets(ctx, video, assetKindHLS, packages.HLSPrefix != "")
+	cfg.retireOutputAssets(ctx, video, assetKindDASH, packages.DASHPrefix != "")
+	cfg.retireOutputAssets(ctx, video, assetKindPreviews, previewPrefix != "")
+	cfg.retireOutputAssets(ctx, video, assetKindPreviewClip, hasPreviewClip)
+	cfg.retireOutputAssets(ctx, video, assetKindSource, hasSource)
+
+	return video, nil
+}
+
+// storeMP4 converts the upload to a faststart MP4 and stores it at videoKey.
+func (cfg *apiConfig) storeMP4(ctx context.Context, video database.Video, sourcePath string, streams VideoInformation, videoKey string) error {
+	duration := streams.duration()
+	reportTranscode := cfg.progress.reporter(video.ID, progressStageTranscode)
+	fastProcessed, err := normalizeToMP4(ctx, sourcePath, streams, func(outTime time.Duration) {
+		reportTranscode(outTime.Milliseconds(), duration.Milliseconds())
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't convert video to mp4: %w", err)
+	}
+	defer os.Remove(fastProcessed)
+
+	fastProcessedVideoFile, err := os.Open(fastProcessed)
+	if err != nil {
+		return fmt.Errorf("couldn't open processed video: %w", err)
+	}
+	defer fastProcessedVideoFile.Close()
+
+	storeCtx := storage.WithProgress(ctx, storage.ProgressFunc(cfg.progress.reporter(video.ID, progressStageStore)))
+	err = cfg.store.Put(storeCtx, videoKey, fastProcessedVideoFile, "video/mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't upload video to storage: %w", err)
+	}
+
+	err = cfg.recordVideoAsset(video, assetKindVideo, videoKey, false, video.VideoURL)
+	if err != nil {
+		return fmt.Errorf("couldn't record video: %w", err)
+	}
+	return nil
+}
+
+// downloadObjectToTemp copies a stored object into a file in the spool
+// directory for ffmpeg and ffprobe. The caller removes the file.
+func (cfg *apiConfig) downloadObjectToTemp(ctx context.Context, key string) (string, error) {
+	body, _, err := cfg.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tempFile, err := os.CreateTemp(cfg.spoolDir, "download-*")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, body); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+func probeVideo(ctx context.Context, filepath string) (VideoInformation, error) {
+	ffProbe := mediaCommand(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filepath)
+	var ffProbeOut bytes.Buffer
+	ffProbe.Stdout = &ffProbeOut
+
+	err := ffProbe.Run()
+	if err != nil {
+		return VideoInformation{}, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	decoder := json.NewDecoder(&ffProbeOut)
+	results := VideoInformation{}
+	videoSuccess := decoder.Decode(&results)
+	if videoSuccess != nil {
+		return VideoInformation{}, videoSuccess
+	}
+	if len(results.Data) < 1 {
+		return VideoInformation{}, fmt.Errorf("Video data set empty")
+	}
+
+	return results, nil
+}
+
+// normalizeToMP4 writes an MP4 with H.264 video, AAC audio and the moov
+// atom at the front. Streams already in those codecs are copied, so an MP4
+// upload is only remuxed. onProgress receives how far into the video ffmpeg
+// has got, parsed from its -progress output.
+func normalizeToMP4(ctx context.Context, filepath string, info VideoInformation, onProgress func(time.Duration)) (string, error) {
+	outputFilepath := fmt.Sprintf("%s.processing", filepath)
+	transcodeVideo, transcodeAudio := info.needsTranscode()
+
+	args := []string{"-i", filepath, "-map", "0:v:0", "-map", "0:a:0?"}
+	if transcodeVideo {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+	if transcodeAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "160k")
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+	args = append(args, "-movflags", "faststart", "-f", "mp4",
+		"-progress", "pipe:1", "-nostats", "-y", outputFilepath)
+
+	ffmpeg := mediaCommand(ctx, "ffmpeg", args...)
+	err := runFFmpegWithProgress(ffmpeg, onProgress)
+	if err != nil {
+		os.Remove(outputFilepath)
+		return "", fmt.Errorf("ffmpeg failed: %w", err)
+	}
+
+	return outputFilepath, nil
+}
+
+// mediaKillDelay bounds how long Wait keeps waiting on the output pipes of
+// a killed ffmpeg or ffprobe.
+const mediaKillDelay = 5 * time.Second
+
+// mediaCommand prepares ffmpeg or ffprobe to run until ctx is done. It runs
+// in its own process group, and the whole group is killed on cancellation so
+// a deleted video's transcode doesn't keep writing output.
+func mediaCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = mediaKillDelay
+	return cmd
+}
+
+// runFFmpegWithProgress runs an ffmpeg command started with "-progress
+// pipe:1" and forwards each out_time_us it reports.
+func runFFmpegWithProgress(ffmpeg *exec.Cmd, onProgress func(time.Duration)) error {
+	stdout, err := ffmpeg.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	ffmpeg.Stderr = &stderr
+
+	if err := ffmpeg.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok || onProgress == nil {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || us < 0 {
+			continue
+		}
+		onProgress(time.Duration(us) * time.Microsecond)
+	}
+	io.Copy(io.Discard, stdout)
+
+	if err := ffmpeg.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// setVideoStatus records a lifecycle change. Failures are only logged since
+// the status never decides whether the work itself succeeded.
+func (cfg *apiConfig) setVideoStatus(videoID uuid.UUID, status string, reason *string) {
+	if err := cfg.db.UpdateVideoStatus(videoID, status, reason); err != nil {
+		log.Printf("Couldn't set status of video %s to %s: %v", videoID, status, err)
+		return
+	}
+	cfg.publishVideoStatus(videoID, status, reason)
+}
+
+func (cfg *apiConfig) publishVideoStatus(videoID uuid.UUID, status string, reason *string) {
+	cfg.progress.publish(progressEvent{
+		VideoID:       videoID,
+		Stage:         progressStageStatus,
+		Status:        status,
+		FailureReason: reason,
+	})
+}
+
+// restoreVideoStatus undoes "uploading" after an upload was abandoned, going
+// back to ready if an earlier upload is still in place.
+func (cfg *apiConfig) restoreVideoStatus(videoID uuid.UUID) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil || video.ID == uuid.Nil || video.Status != database.VideoStatusUploading {
+		return
+	}
+	if video.VideoURL != nil {
+		cfg.setVideoStatus(videoID, database.VideoStatusReady, nil)
+		return
+	}
+	cfg.setVideoStatus(videoID, database.VideoStatusDraft, nil)
+}